@@ -3,13 +3,25 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	_ "github.com/KimMachineGun/automemlimit"
 	"github.com/anthdm/hollywood/actor"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/actors"
-	"github.com/rbenatti8/rinha-de-backend-2025/internal/env"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/config"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/healthy"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/hedge"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/limiter"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/logging"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/reconcile"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/reload"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/retry"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/server"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/spill"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/storage"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/tracing"
 	"github.com/redis/go-redis/v9"
 	"github.com/shopspring/decimal"
 	"github.com/valyala/fasthttp"
@@ -19,66 +31,109 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 func main() {
-	decimal.MarshalJSONWithoutQuotes = true
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelError,
-	})
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
 
-	logger := slog.New(handler)
-	slog.SetDefault(logger)
+		return
+	}
 
-	paymentProcessorDefaultURL := env.GetEnvAsString("PAYMENT_PROCESSOR_URL_DEFAULT", "http://localhost:8001")
-	paymentProcessorFallbackURL := env.GetEnvAsString("PAYMENT_PROCESSOR_URL_FALLBACK", "http://localhost:8002")
-	redisURL := env.GetEnvAsString("REDIS_ADDRESS", "localhost:6379")
+	decimal.MarshalJSONWithoutQuotes = true
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:         redisURL,
-		DB:           0,
-		MinIdleConns: 20,
-		PoolSize:     20,
-		PoolTimeout:  60 * time.Second,
+	if err := logging.Setup(os.Stdout, cfg.Log.Level, cfg.Log.Format); err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		FilePath:    cfg.Tracing.File,
+		SampleRatio: cfg.Tracing.SampleRatio,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	warmupAllRedisConns(rdb, 20)
+	// Redis also carries the routing decisions between instances. With the file backend the service
+	// runs alone and does not need it at all.
+	var rdb *redis.Client
+	var store storage.Store
+
+	switch cfg.Storage.Backend {
+	case "file":
+		store, err = storage.OpenFile(cfg.Storage.Dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "postgres":
+		store, err = storage.OpenPostgres(context.Background(), cfg.Postgres.DSN, cfg.Postgres.MaxConns)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	engine, _ := actor.NewEngine(actor.NewEngineConfig())
+	if cfg.Storage.Backend != "file" {
+		rdb = redis.NewClient(&redis.Options{
+			Addr:         cfg.Redis.Address,
+			DB:           0,
+			MinIdleConns: cfg.Redis.MinIdleConns,
+			PoolSize:     cfg.Redis.PoolSize,
+			PoolTimeout:  cfg.Redis.PoolTimeout,
+		})
+		rdb.AddHook(metrics.RedisHook{})
+
+		warmupAllRedisConns(rdb, cfg.Redis.MinIdleConns)
+	}
 
-	retryTime := env.GetEnvAsInt("RETRY_TIME", 10)
-	maxBackoffDelay := env.GetEnvAsInt("MAX_BACKOFF_DELAY", 500)
-	heapSize := env.GetEnvAsInt("HEAP_SIZE", 1024)
+	if cfg.Storage.Backend == "redis" {
+		store = storage.NewRedis(rdb)
+	}
 
-	readTimeout := env.GetEnvAsInt("READ_TIMEOUT", 500)
-	writeTimeout := env.GetEnvAsInt("WRITE_TIMEOUT", 500)
+	engine, _ := actor.NewEngine(actor.NewEngineConfig())
 
-	paymentProcessorPoolSize := env.GetEnvAsInt("ACTOR_POOL_SIZE", 30)
+	// The adaptive limiters decide how many calls each processor gets, up to limiter.max, so the
+	// client only needs to allow that many connections. Hedged copies wait for a free one.
+	maxProcessorActors := cfg.Pools.ProcessorSize
+	if cfg.Autoscale.Enabled {
+		maxProcessorActors = cfg.Autoscale.Max
+	}
+
+	maxProcessorCalls := min(maxProcessorActors*cfg.Pools.ProcessorConcurrency, cfg.Limiter.Max)
 
 	processorHTTPClient := &fasthttp.Client{
 		TLSConfig: &tls.Config{
 			InsecureSkipVerify: true,
 		},
-		MaxConnsPerHost:               paymentProcessorPoolSize,
-		MaxIdleConnDuration:           120 * time.Second,
-		ReadTimeout:                   time.Duration(readTimeout) * time.Millisecond,
-		WriteTimeout:                  time.Duration(writeTimeout) * time.Millisecond,
-		MaxConnWaitTimeout:            2 * time.Second,
+		MaxConnsPerHost:     maxProcessorCalls,
+		MaxIdleConnDuration: cfg.Processors.MaxIdleConnTime,
+		// Read and write timeouts are set per request by the actors so they can be reloaded.
+		MaxConnWaitTimeout:            cfg.Processors.MaxConnWaitTimeout,
 		DisableHeaderNamesNormalizing: true,
 		DisablePathNormalizing:        true,
 
 		Dial: fasthttp.Dial,
 	}
 
-	isPublisher := env.GetEnvAsBool("IS_PUBLISHER", true)
-
 	t := time.Now()
 
-	warmUpConnections(processorHTTPClient, paymentProcessorDefaultURL+"/payments", paymentProcessorPoolSize)
-	warmUpConnections(processorHTTPClient, paymentProcessorFallbackURL+"/payments", paymentProcessorPoolSize/2)
+	warmUpConnections(processorHTTPClient, cfg.Processors.DefaultURL+"/payments", cfg.Limiter.Initial, cfg.Processors.WriteTimeout+cfg.Processors.ReadTimeout)
+	warmUpConnections(processorHTTPClient, cfg.Processors.FallbackURL+"/payments", cfg.Limiter.Initial/2, cfg.Processors.WriteTimeout+cfg.Processors.ReadTimeout)
 
 	slog.Info("Warm-up connections completed", slog.Duration("duration", time.Since(t)))
 
@@ -87,40 +142,163 @@ func main() {
 			InsecureSkipVerify: true,
 		},
 		MaxConnsPerHost:               2,
-		MaxIdleConnDuration:           120 * time.Second,
-		ReadTimeout:                   10 * time.Second,
-		WriteTimeout:                  10 * time.Second,
-		MaxConnWaitTimeout:            2 * time.Second,
+		MaxIdleConnDuration:           cfg.Processors.MaxIdleConnTime,
+		ReadTimeout:                   cfg.Health.Timeout,
+		WriteTimeout:                  cfg.Health.Timeout,
+		MaxConnWaitTimeout:            cfg.Processors.MaxConnWaitTimeout,
 		DisableHeaderNamesNormalizing: true,
 		DisablePathNormalizing:        true,
 
 		Dial: fasthttp.Dial,
 	}
 
-	hc := healthy.New(rdb, hcHTTPClient, paymentProcessorDefaultURL, paymentProcessorFallbackURL, 500, isPublisher)
+	hc := healthy.New(rdb, hcHTTPClient, cfg.Processors.DefaultURL, cfg.Processors.FallbackURL, healthy.Routing{
+		MaxLatency:            cfg.Health.MaxLatency,
+		FailingGracePeriod:    cfg.Routing.FailingGracePeriod,
+		FallbackLatencyFactor: cfg.Routing.FallbackLatencyFactor,
+	}, cfg.Health.IsPublisher)
 	hc.Start()
 
-	dbActor := engine.Spawn(actors.NewDBActor(rdb), "db-actor")
-	integrityProps := actors.NewIntegrityActor(processorHTTPClient, paymentProcessorDefaultURL, paymentProcessorFallbackURL, dbActor)
-	integrityPool := actors.NewPool(engine, integrityProps, "integrity", 1, 512)
+	supervision := actors.Supervision{
+		MaxRestarts:     cfg.Supervision.MaxRestarts,
+		Window:          cfg.Supervision.Window,
+		MinBackoff:      cfg.Supervision.MinBackoff,
+		MaxBackoff:      cfg.Supervision.MaxBackoff,
+		MaxRedeliveries: cfg.Supervision.MaxRedeliveries,
+	}
 
-	retryActor := engine.Spawn(actors.NewRetryActor(retryTime, maxBackoffDelay, heapSize, hc), "retry-actor", actor.WithInboxSize(heapSize))
-	processorProps := actors.NewPaymentProcessorActor(processorHTTPClient, paymentProcessorDefaultURL, paymentProcessorFallbackURL, rdb, retryActor, integrityPool, hc)
+	spillBuffer, err := spill.Open(cfg.Spill.Dir, cfg.Spill.MemoryLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	processorActorPool := actors.NewPool(engine, processorProps, "processor", paymentProcessorPoolSize, 2048)
+	// The writer, db, maintenance and retry actors have no one to hand over to: when they crash too
+	// often they keep restarting, at the slowest backoff.
+	writerActor := engine.Spawn(actors.NewWriterActor(store, spillBuffer, actors.WriterConfig{
+		BatchSize: cfg.Writer.BatchSize,
+		Window:    cfg.Writer.Window,
+		Pipelines: cfg.Writer.Pipelines,
+		RetryBase: cfg.Writer.RetryBase,
+		RetryMax:  cfg.Writer.RetryMax,
+	}), "writer-actor", supervision.Opts("writer", nil)...)
+	dbActor := engine.Spawn(actors.NewDBActor(store, writerActor, spillBuffer), "db-actor", supervision.Opts("db", nil)...)
+	maintenanceActor := engine.Spawn(actors.NewMaintenanceActor(store), "maintenance-actor", supervision.Opts("maintenance", nil)...)
+	retryPolicies, err := cfg.Tunables().Retry()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	usePreFork := env.GetEnvAsBool("USE_PREFORK", false)
+	retryBudget := retry.NewBudget(cfg.Retry.BudgetRatio, cfg.Retry.BudgetMinPerSecond, cfg.Retry.BudgetBurst)
+	processorStrategy, err := actors.ParseStrategy(cfg.Pools.ProcessorStrategy)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	s := server.New(engine, processorActorPool, dbActor, usePreFork)
-	s.Start(5000)
+	integrityStrategy, err := actors.ParseStrategy(cfg.Pools.IntegrityStrategy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	processorActorPool := actors.NewPool(engine, "processor", cfg.Pools.ProcessorInbox, processorStrategy, supervision)
+
+	retryConfig := new(atomic.Pointer[messages.RetryConfigChanged])
+	retryConfig.Store(&messages.RetryConfigChanged{Interval: cfg.Retry.Interval, Policies: retryPolicies})
+
+	processorConfig := new(atomic.Pointer[messages.ProcessorConfigChanged])
+	processorConfig.Store(&messages.ProcessorConfigChanged{ReadTimeout: cfg.Processors.ReadTimeout, WriteTimeout: cfg.Processors.WriteTimeout})
+
+	retryProps := actors.NewRetryActor(retryConfig, retryBudget, cfg.Retry.DrainRate, cfg.Retry.HeapSize, dbActor, processorActorPool, hc)
+	retryActor := engine.Spawn(retryProps, "retry-actor", append(supervision.Opts("retry", nil), actor.WithInboxSize(cfg.Retry.HeapSize))...)
+
+	integrityProps := actors.NewIntegrityActor(processorHTTPClient, cfg.Processors.DefaultURL, cfg.Processors.FallbackURL, dbActor, retryActor, actors.IntegrityResolution{
+		InitialDelay:          cfg.Integrity.InitialDelay,
+		MaxBackoff:            cfg.Integrity.MaxBackoff,
+		MaxLookups:            cfg.Integrity.MaxLookups,
+		NotFoundConfirmations: cfg.Integrity.NotFoundConfirmations,
+	}, processorConfig)
+	integrityPool := actors.NewPool(engine, "integrity", cfg.Pools.IntegrityInbox, integrityStrategy, supervision)
+	integrityPool.Start(integrityProps, cfg.Pools.IntegritySize)
+
+	var hedger *hedge.Hedger
+	if cfg.Hedge.Enabled {
+		hedger = hedge.New(hedge.Config{
+			Percentile:    cfg.Hedge.Percentile,
+			MinDelay:      cfg.Hedge.MinDelay,
+			Window:        cfg.Hedge.Window,
+			LookupTimeout: cfg.Hedge.LookupTimeout,
+		}, "default", "fallback")
+	}
+
+	limiters := limiter.NewSet(limiter.Config{
+		Initial:          cfg.Limiter.Initial,
+		Min:              cfg.Limiter.Min,
+		Max:              cfg.Limiter.Max,
+		BackoffRatio:     cfg.Limiter.BackoffRatio,
+		LatencyThreshold: cfg.Limiter.LatencyThreshold,
+	}, "default", "fallback")
+
+	processorProps := actors.NewPaymentProcessorActor(processorHTTPClient, cfg.Processors.DefaultURL, cfg.Processors.FallbackURL, dbActor, writerActor, retryActor, retryBudget, hedger, limiters, integrityPool, hc, processorConfig, cfg.Pools.ProcessorConcurrency)
+
+	processorActorPool.Start(processorProps, cfg.Pools.ProcessorSize)
+
+	if cfg.Autoscale.Enabled {
+		actors.NewAutoscaler(processorActorPool, actors.Scaling{
+			Min:        cfg.Autoscale.Min,
+			Max:        cfg.Autoscale.Max,
+			Interval:   cfg.Autoscale.Interval,
+			Cooldown:   cfg.Autoscale.Cooldown,
+			UpDepth:    cfg.Autoscale.UpDepth,
+			DownDepth:  cfg.Autoscale.DownDepth,
+			MaxLatency: cfg.Autoscale.MaxLatency,
+		}).Start()
+	}
+
+	reloader := reload.New(*configPath, cfg, engine, retryActor, retryConfig, processorActorPool, integrityPool, processorConfig, hc)
+
+	reconciler := reconcile.New(hcHTTPClient, engine, dbActor, cfg.Processors.DefaultURL, cfg.Processors.FallbackURL,
+		cfg.Reconcile.Token, cfg.Reconcile.Timeout, cfg.Reconcile.BoundaryTolerance)
+	if cfg.Reconcile.Interval > 0 && cfg.Health.IsPublisher {
+		reconciler.Start(cfg.Reconcile.Interval, cfg.Reconcile.Window, cfg.Reconcile.SettleDelay)
+	}
+
+	if cfg.Retention.Interval > 0 && cfg.Health.IsPublisher {
+		actors.StartRetention(engine, maintenanceActor, cfg.Retention.Interval, cfg.Retention.Age, cfg.Retention.DropAfter)
+	}
+
+	if cfg.Verify.Interval > 0 && cfg.Health.IsPublisher {
+		reconciler.StartSampler(cfg.Verify.Interval, cfg.Verify.Window, cfg.Verify.SampleSize, cfg.Verify.Repair)
+	}
+
+	s := server.New(engine, processorActorPool, dbActor, maintenanceActor, cfg.Server.UsePrefork, cfg.Admin.Token, reloader, hc, reconciler)
+	s.Start(cfg.Server.Port)
+
+	go reloadOnSignal(reloader)
 
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, os.Interrupt)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, os.Interrupt)
 
 	slog.Info(fmt.Sprintf("signal %v received", <-quit), slog.Attr{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Error flushing traces", slog.String("error", err.Error()))
+	}
+}
+
+func reloadOnSignal(reloader *reload.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if _, err := reloader.Reload(); err != nil {
+			slog.Error("Error reloading configuration", slog.String("error", err.Error()))
+		}
+	}
 }
 
-func warmUpConnections(client *fasthttp.Client, endpoint string, count int) {
+func warmUpConnections(client *fasthttp.Client, endpoint string, count int, timeout time.Duration) {
 	const maxWorkers = 100
 
 	tasks := make(chan struct{}, maxWorkers)
@@ -137,6 +315,7 @@ func warmUpConnections(client *fasthttp.Client, endpoint string, count int) {
 
 				req.SetRequestURI(endpoint)
 				req.Header.SetMethod("GET")
+				req.SetTimeout(timeout)
 
 				err := client.Do(req, resp)
 				if err != nil {
@@ -0,0 +1,140 @@
+package actors
+
+import (
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// callLatency accumulates the latency of the processor calls made since the autoscaler last looked.
+var callLatency latencySum
+
+type latencySum struct {
+	total atomic.Int64
+	count atomic.Int64
+}
+
+func (l *latencySum) observe(d time.Duration) {
+	l.total.Add(int64(d))
+	l.count.Add(1)
+}
+
+// take returns the mean latency since the previous call and resets it, or 0 if there was no call.
+func (l *latencySum) take() time.Duration {
+	total, count := l.total.Swap(0), l.count.Swap(0)
+	if count == 0 {
+		return 0
+	}
+
+	return time.Duration(total / count)
+}
+
+// Scaling holds the bounds and thresholds of an Autoscaler.
+type Scaling struct {
+	Min int
+	Max int
+	// Interval is how often the pool is looked at.
+	Interval time.Duration
+	// Cooldown is the minimum time between two decisions.
+	Cooldown time.Duration
+	// UpDepth and DownDepth are the mean load per member, the payments queued on it or waiting in
+	// it for a call, above which the pool grows and below which it shrinks.
+	UpDepth   float64
+	DownDepth float64
+	// MaxLatency is the mean call latency above which the processors, not the actors, are the
+	// bottleneck: the pool is then left as it is.
+	MaxLatency time.Duration
+}
+
+// Autoscaler resizes the processor pool between Min and Max. The pool grows by a quarter when
+// payments pile up in its actors and shrinks one actor at a time when they are nearly idle.
+// While calls are slow it holds: more actors would only queue more calls on an overloaded
+// processor, and fewer would leave the ones already queued waiting longer once it recovers.
+type Autoscaler struct {
+	pool         *Pool
+	scaling      Scaling
+	lastDecision time.Time
+}
+
+func NewAutoscaler(pool *Pool, scaling Scaling) *Autoscaler {
+	return &Autoscaler{pool: pool, scaling: scaling}
+}
+
+// Start looks at the pool every Interval until the process exits.
+func (a *Autoscaler) Start() {
+	go func() {
+		ticker := time.NewTicker(a.scaling.Interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			a.scale(now)
+		}
+	}()
+}
+
+func (a *Autoscaler) scale(now time.Time) {
+	latency := callLatency.take()
+	size := a.pool.Size()
+
+	var load int64
+	for _, l := range a.pool.Loads() {
+		load += l.Depth
+	}
+
+	mean := float64(load) / float64(size)
+
+	metrics.PoolMeanLoad.WithLabelValues(a.pool.kind).Set(mean)
+
+	if now.Sub(a.lastDecision) < a.scaling.Cooldown {
+		return
+	}
+
+	var target int
+	var reason string
+
+	switch {
+	case mean > a.scaling.UpDepth && size < a.scaling.Max:
+		if latency > a.scaling.MaxLatency {
+			a.lastDecision = now
+			a.decide("hold", size, size, mean, latency, "processors are slow")
+			return
+		}
+
+		target, reason = min(a.scaling.Max, size+max(1, size/4)), "payments are piling up"
+	case mean < a.scaling.DownDepth && size > a.scaling.Min && latency <= a.scaling.MaxLatency:
+		target, reason = size-1, "actors are nearly idle"
+	default:
+		return
+	}
+
+	for n := size; n < target; n++ {
+		a.pool.Add()
+	}
+
+	for n := size; n > target; n-- {
+		a.pool.Remove()
+	}
+
+	decision := "up"
+	if target < size {
+		decision = "down"
+	}
+
+	a.lastDecision = now
+	a.decide(decision, size, target, mean, latency, reason)
+}
+
+func (a *Autoscaler) decide(decision string, from, to int, mean float64, latency time.Duration, reason string) {
+	metrics.PoolScaleDecisions.WithLabelValues(a.pool.kind, decision).Inc()
+
+	slog.Info("Pool scaling decision",
+		slog.String("pool", a.pool.kind),
+		slog.String("decision", decision),
+		slog.Int("from", from),
+		slog.Int("to", to),
+		slog.Float64("meanLoad", mean),
+		slog.Duration("latency", latency),
+		slog.String("reason", reason),
+	)
+}
@@ -3,176 +3,184 @@ package actors
 import (
 	"context"
 	"github.com/anthdm/hollywood/actor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/logging"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
-	"github.com/redis/go-redis/v9"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/record"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/spill"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/storage"
 	"github.com/shopspring/decimal"
 	"log/slog"
-	"strconv"
-	"strings"
-	"sync"
 	"time"
 )
 
-var (
-	bufPool = sync.Pool{
-		New: func() any {
-			b := make([]byte, 0, 64)
-			return &b
-		},
-	}
-
-	ctx = context.Background()
-
-	keyPaymentsAll = "payments:all"
-)
-
 type DBActor struct {
-	client *redis.Client
+	store  storage.Store
+	writer *actor.PID
+	spill  *spill.Buffer
 }
 
 func (a *DBActor) Receive(c *actor.Context) {
 	switch msg := c.Message().(type) {
 	case messages.PushPayment:
-		a.pushPayment(msg)
+		c.Forward(a.writer)
 	case messages.SummarizePayments:
 		a.summarize(c, msg)
+	case messages.ListPayments:
+		a.listPayments(c, msg)
+	case messages.QuarantinePayments:
+		a.quarantinePayments(c, msg)
+	case messages.DeadLetterPayment:
+		a.deadLetterPayment(msg)
 	case messages.PurgePayments:
 		a.purgePayments(c)
 	}
 }
 
 func (a *DBActor) purgePayments(c *actor.Context) {
-	err := a.client.Del(context.Background(), keyPaymentsAll).Err()
-	if err != nil {
-		slog.Error("Error purging payments from Redis", slog.String("error", err.Error()))
+	if err := a.store.Purge(context.Background()); err != nil {
+		slog.Error("Error purging payments", slog.String("error", err.Error()))
 	}
 
 	c.Respond(struct{}{})
 }
 
-func (a *DBActor) pushPayment(msg messages.PushPayment) {
-	bufPtr := bufPool.Get().(*[]byte)
-	buf := (*bufPtr)[:0]
-
-	buf = append(buf, msg.Payment.CID...)
-	buf = append(buf, '|')
-	buf = strconv.AppendFloat(buf, msg.Payment.Amount, 'f', -1, 64)
-	buf = append(buf, '|')
-	buf = append(buf, msg.Payment.RequestedAt...)
-	buf = append(buf, '|')
-	buf = append(buf, msg.ProcessedBy...)
-
-	timeToArrive := time.Since(msg.ProcessedAt)
-	if timeToArrive > 100*time.Millisecond {
-		slog.Warn("Payment took too long to arrive", slog.String("ActorID", msg.Payment.CID), slog.Duration("time_to_arrive", timeToArrive))
+// deadLetterPayment keeps a payment whose outcome could not be determined out of the summaries,
+// along with why, so it can be looked at by hand.
+func (a *DBActor) deadLetterPayment(msg messages.DeadLetterPayment) {
+	deadLetter(a.store, msg)
+}
+
+func deadLetter(store storage.Store, msg messages.DeadLetterPayment) {
+	if err := store.DeadLetter(context.Background(), msg); err != nil {
+		logging.Payment(slog.LevelError, "Error dead lettering payment", msg.Payment.CID, msg.Processor, 0, slog.String("error", err.Error()))
 	}
+}
 
-	t := time.Now()
-	err := a.client.RPush(ctx, keyPaymentsAll, string(buf)).Err()
+func (a *DBActor) summarize(c *actor.Context, msg messages.SummarizePayments) {
+	summary, err := a.sum(msg)
 	if err != nil {
-		slog.Error("Error pushing payments to Redis", slog.String("error", err.Error()))
+		slog.Error("Error reading payments", slog.String("error", err.Error()))
+		c.Respond(struct{}{})
+		return
 	}
 
-	if time.Since(t) > 100*time.Millisecond {
-		slog.Warn("Slow push to Redis", slog.String("CID", msg.Payment.CID), slog.Duration("duration", time.Since(t)))
-	}
+	// Payments waiting in the spill buffer are processed but not counted yet.
+	summary.Incomplete = a.spill.Len() > 0
 
-	bufPool.Put(bufPtr)
+	c.Respond(summary)
 }
 
-func (a *DBActor) pushBatchPayment(msgs []messages.PushPayment) {
-	if len(msgs) == 0 {
-		return
+// sum adds up the payments requested within the range, letting the store do it when it can.
+func (a *DBActor) sum(msg messages.SummarizePayments) (messages.SummarizedPayments, error) {
+	if s, ok := a.store.(storage.Summarizer); ok {
+		return s.Summarize(context.Background(), msg.From, msg.To)
 	}
 
-	values := make([]interface{}, 0, len(msgs))
+	summary := messages.SummarizedPayments{}
+	cidMap := make(map[string]struct{})
+
+	malformed, err := a.store.Scan(context.Background(), msg.From, msg.To, func(r record.Record) {
+		if _, exists := cidMap[r.CID]; exists {
+			slog.Warn("Duplicate CID found, skipping", slog.String("correlationId", r.CID))
+			return
+		}
 
-	for _, msg := range msgs {
-		bufPtr := bufPool.Get().(*[]byte)
-		buf := (*bufPtr)[:0]
+		cidMap[r.CID] = struct{}{}
 
-		buf = append(buf, msg.Payment.CID...)
-		buf = append(buf, '|')
-		buf = strconv.AppendFloat(buf, msg.Payment.Amount, 'f', -1, 64)
-		buf = append(buf, '|')
-		buf = append(buf, msg.Payment.RequestedAt...)
-		buf = append(buf, '|')
-		buf = append(buf, msg.ProcessedBy...)
+		if msg.From != nil && r.RequestedAt.Before(*msg.From) {
+			return
+		}
 
-		values = append(values, string(buf))
+		if msg.To != nil && r.RequestedAt.After(*msg.To) {
+			return
+		}
 
-		bufPool.Put(bufPtr)
-	}
+		value := decimal.New(r.Cents, -2)
 
-	start := time.Now()
-	err := a.client.RPush(context.Background(), keyPaymentsAll, values...).Err()
+		if r.Processor == "default" {
+			summary.Default.TotalAmount = summary.Default.TotalAmount.Add(value)
+			summary.Default.TotalRequests++
+			return
+		}
+
+		summary.Fallback.TotalAmount = summary.Fallback.TotalAmount.Add(value)
+		summary.Fallback.TotalRequests++
+	})
 	if err != nil {
-		slog.Error("Error pushing payments to Redis", slog.String("error", err.Error()))
+		return summary, err
 	}
 
-	if dur := time.Since(start); dur > 100*time.Millisecond {
-		slog.Warn("Slow batch push to Redis", slog.Int("count", len(msgs)), slog.Duration("duration", dur))
+	if malformed > 0 {
+		slog.Warn("Malformed payment records skipped", slog.Int("count", malformed))
 	}
-}
-
-func (a *DBActor) summarize(c *actor.Context, msg messages.SummarizePayments) {
-	summary := messages.SummarizedPayments{}
 
-	lines, err := a.client.LRange(context.Background(), keyPaymentsAll, 0, -1).Result()
-	if err != nil {
-		slog.Error("Error pulling payments from Redis", slog.String("error", err.Error()))
-		c.Respond(struct{}{})
-	}
+	return summary, nil
+}
 
+// listPayments returns the stored payments requested within the range, plus the correlationIds
+// stored more than once and the number of records that could not be parsed.
+func (a *DBActor) listPayments(c *actor.Context, msg messages.ListPayments) {
+	listed := messages.ListedPayments{}
 	cidMap := make(map[string]struct{})
 
-	for _, line := range lines {
-		fields := strings.Split(line, "|")
-
-		if _, exists := cidMap[fields[0]]; exists {
-			slog.Warn("Duplicate CID found, skipping", slog.String("CID", fields[0]))
-			continue
+	malformed, err := a.store.Scan(context.Background(), msg.From, msg.To, func(r record.Record) {
+		if _, exists := cidMap[r.CID]; exists {
+			listed.Duplicates = append(listed.Duplicates, r.CID)
+			return
 		}
 
-		cidMap[fields[0]] = struct{}{}
+		cidMap[r.CID] = struct{}{}
 
-		requestedAt := fields[2]
-		if msg.From != nil {
-			timestamp, _ := time.Parse(time.RFC3339Nano, requestedAt)
-			if timestamp.UTC().Before(*msg.From) {
-				continue
-			}
+		if msg.From != nil && r.RequestedAt.Before(*msg.From) {
+			return
 		}
 
-		if msg.To != nil {
-			timestamp, _ := time.Parse(time.RFC3339Nano, requestedAt)
-			if timestamp.UTC().After(*msg.To) {
-				continue
-			}
+		if msg.To != nil && r.RequestedAt.After(*msg.To) {
+			return
 		}
 
-		processedBy := fields[3]
+		listed.Payments = append(listed.Payments, messages.StoredPayment{
+			Payment: messages.Payment{
+				CID:         r.CID,
+				Amount:      r.Amount(),
+				RequestedAt: r.RequestedAt.Format(time.RFC3339Nano),
+			},
+			ProcessedBy: r.Processor,
+		})
+	})
+	if err != nil {
+		slog.Error("Error reading payments", slog.String("error", err.Error()))
+		c.Respond(err)
+		return
+	}
 
-		amount := fields[1]
-		value, _ := decimal.NewFromString(amount)
+	listed.Malformed = malformed
 
-		if processedBy == "default" {
-			summary.Default.TotalAmount = summary.Default.TotalAmount.Add(value)
-			summary.Default.TotalRequests++
-			continue
-		}
+	c.Respond(listed)
+}
 
-		summary.Fallback.TotalAmount = summary.Fallback.TotalAmount.Add(value)
-		summary.Fallback.TotalRequests++
+// quarantinePayments moves the payments of the given correlationIds out of the stored payments, so
+// they no longer count in summaries, to where they can still be inspected.
+func (a *DBActor) quarantinePayments(c *actor.Context, msg messages.QuarantinePayments) {
+	moved, err := a.store.Quarantine(context.Background(), msg.CIDs)
+	if err != nil {
+		slog.Error("Error quarantining payments", slog.String("error", err.Error()))
+		c.Respond(err)
+		return
 	}
 
-	c.Respond(summary)
+	slog.Warn("Payments quarantined", slog.Int("count", moved), slog.Any("correlationIds", msg.CIDs))
+	c.Respond(messages.QuarantinedPayments{Count: moved})
 }
 
-func NewDBActor(client *redis.Client) actor.Producer {
+// NewDBActor creates the actor that reads the stored payments. Payments to store
+// are handed over to writer, which keeps those it cannot store yet in spill.
+func NewDBActor(store storage.Store, writer *actor.PID, spill *spill.Buffer) actor.Producer {
 	return func() actor.Receiver {
 		return &DBActor{
-			client: client,
+			store:  store,
+			writer: writer,
+			spill:  spill,
 		}
 	}
 }
@@ -1,94 +1,262 @@
 package actors
 
 import (
-	"fmt"
+	"errors"
 	"github.com/anthdm/hollywood/actor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/logging"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/outcome"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/processor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/tracing"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sync/atomic"
 	"time"
 )
 
+// IntegrityResolution holds the knobs of the timeout resolution state machine.
+type IntegrityResolution struct {
+	InitialDelay          time.Duration
+	MaxBackoff            time.Duration
+	MaxLookups            int
+	NotFoundConfirmations int
+}
+
+// IntegrityActor resolves payments whose processor call timed out. Each round looks the payment up
+// on the processor it timed out on and on any other processor it was dispatched to before. A round
+// ends in one of three decisions:
+//
+//   - found on a processor: the payment was processed and is recorded against that processor;
+//   - not found on any of them NotFoundConfirmations rounds in a row: it was not processed and is
+//     handed back to the retry actor to be dispatched again;
+//   - MaxLookups rounds without a decision: the outcome is unknown and the payment is dead lettered.
+//
+// Rounds are spaced with an exponential backoff starting at InitialDelay.
 type IntegrityActor struct {
-	client               *fasthttp.Client
-	defaultProcessorURL  string
-	fallbackProcessorURL string
-	dbActor              *actor.PID
+	client       *fasthttp.Client
+	urls         map[string]string
+	dbActor      *actor.PID
+	retryActor   *actor.PID
+	resolution   IntegrityResolution
+	timeouts     *atomic.Pointer[messages.ProcessorConfigChanged]
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	draining     bool
 }
 
 func (a *IntegrityActor) Receive(c *actor.Context) {
 	switch m := c.Message().(type) {
-	case messages.CheckIntegrity:
-		if m.Processor == "fallback" {
-			a.checkFallback(c, m)
-			return
+	case actor.Started:
+		// Actors started after a reload, or restarted after a crash, did not receive the change.
+		t := a.timeouts.Load()
+		a.readTimeout, a.writeTimeout = t.ReadTimeout, t.WriteTimeout
+	case actor.Stopped:
+		// After a crash the actor restarts under the same PID. The lookups it scheduled still fire
+		// there and are still counted, so only draining is handed over.
+		if a.draining {
+			send(c.Engine(), c.PID(), messages.Drain{})
 		}
+	case messages.ProcessorConfigChanged:
+		a.readTimeout = m.ReadTimeout
+		a.writeTimeout = m.WriteTimeout
+	case messages.CheckIntegrity:
+		a.scheduleLookup(c, m)
+	case messages.LookupIntegrity:
+		// Counted off only once done: a lookup that crashes the actor is delivered again.
+		a.lookup(c, m.Check)
+		addWork(c, -1)
+		a.stopIfDrained(c)
+	case messages.Drain:
+		a.draining = true
+		a.stopIfDrained(c)
+	}
+}
 
-		a.checkDefault(c, m)
+// stopIfDrained stops an actor removed from its pool once it has no lookup scheduled. Draining is
+// over by then: it is not handed over on Stopped.
+func (a *IntegrityActor) stopIfDrained(c *actor.Context) {
+	if a.draining && addWork(c, 0) == 0 {
+		a.draining = false
+		c.Engine().Poison(c.PID())
 	}
 }
 
-func (a *IntegrityActor) checkFallback(c *actor.Context, m messages.CheckIntegrity) {
-	req := fasthttp.AcquireRequest()
-	resp := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseRequest(req)
-	defer fasthttp.ReleaseResponse(resp)
+// scheduleLookup counts the lookup as work of the actor until it is done, so that the count survives
+// a restart along with the timer and a draining actor waits for it.
+func (a *IntegrityActor) scheduleLookup(c *actor.Context, m messages.CheckIntegrity) {
+	engine, pid := c.Engine(), c.PID()
+	addWork(c, 1)
 
-	req.SetRequestURI(a.fallbackProcessorURL + fmt.Sprintf("/%s", m.Payment.CID))
-	req.Header.SetMethod(fasthttp.MethodGet)
+	time.AfterFunc(a.delay(m.Lookups), func() {
+		send(engine, pid, messages.LookupIntegrity{Check: m})
+	})
+}
 
-	err := a.client.Do(req, resp)
-	if shouldRetry(resp, err) {
-		c.Send(c.PID(), m)
-		return
+func (a *IntegrityActor) delay(lookups int) time.Duration {
+	d := a.resolution.InitialDelay
+	for i := 0; i < lookups && d < a.resolution.MaxBackoff; i++ {
+		d *= 2
 	}
 
-	c.Send(a.dbActor, messages.PushPayment{
-		Payment:     m.Payment,
-		ProcessedBy: m.Processor,
-	})
+	return min(d, a.resolution.MaxBackoff)
 }
 
-func (a *IntegrityActor) checkDefault(c *actor.Context, m messages.CheckIntegrity) {
-	req := fasthttp.AcquireRequest()
-	resp := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseRequest(req)
-	defer fasthttp.ReleaseResponse(resp)
+func (a *IntegrityActor) lookup(c *actor.Context, m messages.CheckIntegrity) {
+	span := tracing.Start(m.Trace, "integrity.check",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("payment.correlation_id", m.Payment.CID),
+			attribute.String("payment.processor", m.Processor),
+			attribute.Int("integrity.lookup", m.Lookups+1),
+		),
+	)
+	defer span.End()
+
+	m.Lookups++
+	failed := false
+
+	for _, p := range a.candidates(m) {
+		charged, err := processor.Lookup(a.client, a.urls[p], m.Payment.CID, a.writeTimeout+a.readTimeout)
+
+		switch {
+		case err == nil:
+			metrics.IntegrityChecks.WithLabelValues(p, "found").Inc()
+			a.processed(c, m, p, charged, span)
+			return
+		case errors.Is(err, processor.ErrNotFound):
+			metrics.IntegrityChecks.WithLabelValues(p, "not_found").Inc()
+		default:
+			// Errors that are not a processor outcome come from a response that could not be read.
+			label := "invalid_response"
+			o, ok := outcome.Of(err)
+			if ok {
+				label = o.String()
+			}
+
+			metrics.IntegrityChecks.WithLabelValues(p, label).Inc()
+			logging.Payment(slog.LevelDebug, "Integrity lookup failed", m.Payment.CID, p, m.Tries, slog.String("error", err.Error()))
+
+			// A rejected lookup will keep being rejected, so waiting for it is pointless.
+			if o == outcome.Rejected {
+				a.deadLetter(c, m, span, "lookup rejected by "+p)
+				return
+			}
+
+			failed = true
+		}
+	}
+
+	// Only rounds where every lookup got an answer count as confirmations; a failed lookup says
+	// nothing about whether the payment exists.
+	if failed {
+		m.NotFound = 0
+	} else {
+		m.NotFound++
+	}
 
-	req.SetRequestURI(a.defaultProcessorURL + fmt.Sprintf("/%s", m.Payment.CID))
-	req.Header.SetMethod(fasthttp.MethodGet)
+	if m.NotFound >= a.resolution.NotFoundConfirmations {
+		a.redispatch(c, m, span)
+		return
+	}
 
-	err := a.client.Do(req, resp)
-	if shouldRetry(resp, err) {
-		c.Send(c.PID(), m)
+	if m.Lookups >= a.resolution.MaxLookups {
+		a.deadLetter(c, m, span, "unresolved timeout")
 		return
 	}
 
+	a.scheduleLookup(c, m)
+}
+
+// candidates lists the processors that may hold the payment: the one the call timed out on first,
+// then the other one if an earlier attempt was dispatched there.
+func (a *IntegrityActor) candidates(m messages.CheckIntegrity) []string {
+	other := defaultPaymentProcessor
+	if m.Processor == defaultPaymentProcessor {
+		other = fallbackPaymentProcessor
+	}
+
+	if m.Dispatched.Has(other) {
+		return []string{m.Processor, other}
+	}
+
+	return []string{m.Processor}
+}
+
+func (a *IntegrityActor) processed(c *actor.Context, m messages.CheckIntegrity, p string, charged messages.Payment, span trace.Span) {
+	metrics.IntegrityOutcomes.WithLabelValues("processed").Inc()
+	logging.Payment(slog.LevelDebug, "Timed out payment was processed", m.Payment.CID, p, m.Tries, slog.Int("lookups", m.Lookups))
+
+	// Record what the processor charged: when it is an earlier attempt, its requestedAt is not the
+	// one of the call that timed out.
 	c.Send(a.dbActor, messages.PushPayment{
-		Payment:     m.Payment,
-		ProcessedBy: m.Processor,
+		Payment:     charged,
+		ProcessedBy: p,
 		ProcessedAt: time.Now().UTC(),
+		Tries:       m.Tries,
+		Trace:       span.SpanContext(),
 	})
 }
 
-func shouldRetry(resp *fasthttp.Response, err error) bool {
-	if err != nil {
-		return true
-	}
+func (a *IntegrityActor) redispatch(c *actor.Context, m messages.CheckIntegrity, span trace.Span) {
+	metrics.IntegrityOutcomes.WithLabelValues("redispatched").Inc()
+	logging.Payment(slog.LevelWarn, "Timed out payment was not processed, dispatching again", m.Payment.CID, m.Processor, m.Tries, slog.Int("lookups", m.Lookups))
+
+	c.Send(a.retryActor, messages.ScheduleRetry{
+		Payment:    m.Payment,
+		Tries:      m.Tries,
+		Dispatched: m.Dispatched,
+		Processor:  m.Processor,
+		Outcome:    outcome.TimeoutAfterSend,
+		Trace:      span.SpanContext(),
+	})
+}
+
+func (a *IntegrityActor) deadLetter(c *actor.Context, m messages.CheckIntegrity, span trace.Span, reason string) {
+	span.SetStatus(codes.Error, "outcome unknown")
+	metrics.IntegrityOutcomes.WithLabelValues("dead_letter").Inc()
+	logging.Payment(slog.LevelError, "Could not resolve timed out payment, dead lettering it", m.Payment.CID, m.Processor, m.Tries, slog.Int("lookups", m.Lookups), slog.String("reason", reason))
 
-	return resp.StatusCode() != fasthttp.StatusOK
+	c.Send(a.dbActor, messages.DeadLetterPayment{
+		Payment:   m.Payment,
+		Processor: m.Processor,
+		Reason:    reason,
+	})
+}
+
+// dropped dead letters a payment whose check kept crashing the actor.
+func (a *IntegrityActor) dropped(c *actor.Context, msg any, reason string) {
+	switch m := msg.(type) {
+	case messages.CheckIntegrity:
+		c.Send(a.dbActor, messages.DeadLetterPayment{Payment: m.Payment, Processor: m.Processor, Reason: reason})
+	case messages.LookupIntegrity:
+		c.Send(a.dbActor, messages.DeadLetterPayment{Payment: m.Check.Payment, Processor: m.Check.Processor, Reason: reason})
+		addWork(c, -1)
+		a.stopIfDrained(c)
+	}
 }
 
 func NewIntegrityActor(
 	client *fasthttp.Client,
 	defaultURL, fallbackURL string,
-	dbActor *actor.PID,
+	dbActor, retryActor *actor.PID,
+	resolution IntegrityResolution,
+	timeouts *atomic.Pointer[messages.ProcessorConfigChanged],
 ) actor.Producer {
 	return func() actor.Receiver {
 		return &IntegrityActor{
-			client:               client,
-			defaultProcessorURL:  defaultURL + "/payments",
-			fallbackProcessorURL: fallbackURL + "/payments",
-			dbActor:              dbActor,
+			client: client,
+			urls: map[string]string{
+				defaultPaymentProcessor:  defaultURL,
+				fallbackPaymentProcessor: fallbackURL,
+			},
+			dbActor:    dbActor,
+			retryActor: retryActor,
+			resolution: resolution,
+			timeouts:   timeouts,
 		}
 	}
 }
@@ -0,0 +1,96 @@
+package actors
+
+import (
+	"github.com/anthdm/hollywood/actor"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"sync/atomic"
+)
+
+// mailboxes tracks the queue depth of every pooled actor, keyed by PID ID.
+var mailboxes sync.Map
+
+// mailbox counts the messages queued on an actor. gauge is shared by the whole pool and
+// memberGauge belongs to the actor alone. work is what the actor took off its mailbox but has not
+// finished yet, as it reports it with reportWork.
+type mailbox struct {
+	depth       atomic.Int64
+	work        atomic.Int64
+	gauge       prometheus.Gauge
+	memberGauge prometheus.Gauge
+}
+
+// load is how busy the actor is: the messages queued on it and the work it holds.
+func (m *mailbox) load() int64 {
+	return m.depth.Load() + m.work.Load()
+}
+
+func (m *mailbox) enqueue() {
+	m.depth.Add(1)
+	m.gauge.Inc()
+	m.memberGauge.Inc()
+}
+
+func (m *mailbox) dequeue() {
+	for {
+		d := m.depth.Load()
+		if d <= 0 {
+			return
+		}
+
+		if m.depth.CompareAndSwap(d, d-1) {
+			m.gauge.Dec()
+			m.memberGauge.Dec()
+			return
+		}
+	}
+}
+
+// reportWork records the work an actor of a pool holds outside of its mailbox.
+func reportWork(c *actor.Context, n int) {
+	if v, ok := mailboxes.Load(c.PID().ID); ok {
+		v.(*mailbox).work.Store(int64(n))
+	}
+}
+
+// addWork adds n to the work an actor of a pool holds and returns the new amount. The count is kept
+// with the mailbox, which outlives a restart, for work that outlives the receiver such as timers.
+func addWork(c *actor.Context, n int64) int64 {
+	if v, ok := mailboxes.Load(c.PID().ID); ok {
+		return v.(*mailbox).work.Add(n)
+	}
+
+	return 0
+}
+
+// send delivers msg to pid, counting it against the pid's mailbox when it belongs to a pool.
+func send(e *actor.Engine, pid *actor.PID, msg any) {
+	if v, ok := mailboxes.Load(pid.ID); ok {
+		v.(*mailbox).enqueue()
+	}
+
+	e.Send(pid, msg)
+}
+
+// resend puts msg back at the end of the mailbox of the actor handling it, keeping its sender.
+func resend(c *actor.Context, msg any) {
+	if v, ok := mailboxes.Load(c.PID().ID); ok {
+		v.(*mailbox).enqueue()
+	}
+
+	c.Engine().SendWithSender(c.PID(), msg, c.Sender())
+}
+
+func countReceived(m *mailbox) actor.MiddlewareFunc {
+	return func(next actor.ReceiveFunc) actor.ReceiveFunc {
+		return func(c *actor.Context) {
+			switch c.Message().(type) {
+			case actor.Initialized, actor.Started, actor.Stopped:
+			default:
+				m.dequeue()
+			}
+
+			next(c)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package actors
+
+import (
+	"context"
+	"fmt"
+	"github.com/anthdm/hollywood/actor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/record"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/storage"
+	"log/slog"
+	"time"
+)
+
+// MaintenanceActor runs the long maintenance tasks on the store, one at a time. They can take
+// minutes, so they are kept off the db actor, which must keep answering the summaries.
+type MaintenanceActor struct {
+	store storage.Store
+}
+
+func (a *MaintenanceActor) Receive(c *actor.Context) {
+	switch msg := c.Message().(type) {
+	case messages.MigratePayments:
+		a.migratePayments(c)
+	case messages.ArchivePayments, messages.ListArchives, messages.ExportArchives, messages.CompactArchives, messages.DropArchives:
+		a.manageArchives(c, msg)
+	}
+}
+
+// migratePayments rewrites the payments stored in an older format. It can run while payments are
+// being stored, and again.
+func (a *MaintenanceActor) migratePayments(c *actor.Context) {
+	migrated, err := a.store.Migrate(context.Background())
+	if err != nil {
+		slog.Error("Error migrating payments", slog.Int("migrated", migrated.Migrated), slog.String("error", err.Error()))
+		c.Respond(err)
+		return
+	}
+
+	slog.Warn("Payments migrated",
+		slog.Int("migrated", migrated.Migrated),
+		slog.Int("skipped", migrated.Skipped),
+		slog.Int("malformed", migrated.Malformed),
+	)
+	c.Respond(migrated)
+}
+
+// manageArchives handles the archive messages, if the store keeps archives.
+func (a *MaintenanceActor) manageArchives(c *actor.Context, msg any) {
+	archiver, ok := a.store.(storage.Archiver)
+	if !ok {
+		c.Respond(storage.ErrArchivesUnsupported)
+		return
+	}
+
+	ctx := context.Background()
+
+	var res any
+	var err error
+
+	switch m := msg.(type) {
+	case messages.ArchivePayments:
+		var archived messages.ArchivedPayments
+		archived, err = archiver.Archive(ctx, m.Before)
+		if err == nil {
+			slog.Warn("Payments archived", slog.Int("count", archived.Archived), slog.Any("days", archived.Days), slog.Int("quarantined", archived.Quarantined))
+		}
+
+		res = archived
+	case messages.ListArchives:
+		var archives []messages.Archive
+		archives, err = archiver.Archives(ctx)
+		res = messages.ListedArchives{Archives: archives}
+	case messages.ExportArchives:
+		exported := messages.ExportedArchives{}
+		err = archiver.Export(ctx, m.Before, func(r record.Record) {
+			exported.Payments = append(exported.Payments, messages.StoredPayment{
+				Payment: messages.Payment{
+					CID:         r.CID,
+					Amount:      r.Amount(),
+					RequestedAt: r.RequestedAt.Format(time.RFC3339Nano),
+				},
+				ProcessedBy: r.Processor,
+			})
+		})
+		res = exported
+	case messages.CompactArchives:
+		var compacted messages.CompactedArchives
+		compacted, err = archiver.Compact(ctx, m.Before)
+		if err == nil {
+			slog.Warn("Archives compacted", slog.Int("days", compacted.Days), slog.Int("parts", compacted.Parts), slog.Int("duplicates", compacted.Duplicates))
+		}
+
+		res = compacted
+	case messages.DropArchives:
+		var dropped messages.DroppedArchives
+		dropped, err = archiver.Drop(ctx, m.Before)
+		if err == nil {
+			slog.Warn("Archives dropped", slog.Int("days", dropped.Days), slog.Int("parts", dropped.Parts), slog.Time("before", storage.StartOfDay(m.Before)))
+		}
+
+		res = dropped
+	}
+
+	if err != nil {
+		slog.Error("Error managing archives", slog.String("message", fmt.Sprintf("%T", msg)), slog.String("error", err.Error()))
+		c.Respond(err)
+		return
+	}
+
+	c.Respond(res)
+}
+
+// NewMaintenanceActor creates the actor that maintains the stored payments.
+func NewMaintenanceActor(store storage.Store) actor.Producer {
+	return func() actor.Receiver {
+		return &MaintenanceActor{store: store}
+	}
+}
@@ -3,31 +3,351 @@ package actors
 import (
 	"fmt"
 	"github.com/anthdm/hollywood/actor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
 	"hash/fnv"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
 )
 
+// Strategy decides which member of a pool gets a message.
+type Strategy uint8
+
+const (
+	// StrategyHash sends every message for a key to the same member, so they are handled in order.
+	StrategyHash Strategy = iota
+	// StrategyRoundRobin cycles through the members.
+	StrategyRoundRobin
+	// StrategyLeastQueued picks the least loaded member: the fewest messages queued on it and work
+	// held by it.
+	StrategyLeastQueued
+	// StrategyP2C picks the less loaded of two random members, close to least-queued without
+	// looking at every member.
+	StrategyP2C
+)
+
+var strategyNames = map[string]Strategy{
+	"hash":         StrategyHash,
+	"round-robin":  StrategyRoundRobin,
+	"least-queued": StrategyLeastQueued,
+	"p2c":          StrategyP2C,
+}
+
+// ParseStrategy returns the strategy named s: hash, round-robin, least-queued or p2c.
+func ParseStrategy(s string) (Strategy, error) {
+	st, ok := strategyNames[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown pool strategy %q, must be one of hash, round-robin, least-queued, p2c", s)
+	}
+
+	return st, nil
+}
+
+// Pool spreads messages over a set of actors of the same kind. With StrategyHash, keys are mapped
+// to members with rendezvous hashing, so adding or removing a member only moves the keys that
+// belong to it; the other strategies ignore the key and balance on load, trading per-key ordering
+// for not queueing behind a member stuck on a slow call. A supervisor re-spawns members that die,
+// under the same name so they keep their keys.
 type Pool struct {
-	actors []*actor.PID
-	size   int
+	engine      *actor.Engine
+	props       actor.Producer
+	kind        string
+	inboxSize   int
+	strategy    Strategy
+	supervision Supervision
+	rr          atomic.Uint64
+
+	mu      sync.RWMutex
+	members []*member
+	// draining holds the members taken out of the pool until they stop, by PID ID, so the
+	// messages they still handle are counted.
+	draining   map[string]*member
+	next       int
+	supervisor *actor.PID
+}
+
+type member struct {
+	name string
+	seed uint64
+	pid  *actor.PID
+	mb   *mailbox
+}
+
+// MemberLoad is the load of a pool member: the messages queued on it and the work it holds.
+type MemberLoad struct {
+	Name  string `json:"name"`
+	Depth int64  `json:"depth"`
 }
 
 func (p *Pool) GetActor(name string) *actor.PID {
-	hash := fnv.New32a()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.pick(name).pid
+}
+
+// pick returns the member that gets a message for key. Must be called with p.mu held.
+func (p *Pool) pick(key string) *member {
+	switch p.strategy {
+	case StrategyRoundRobin:
+		return p.members[p.rr.Add(1)%uint64(len(p.members))]
+	case StrategyLeastQueued:
+		best := p.members[0]
+		for _, m := range p.members[1:] {
+			if m.mb.load() < best.mb.load() {
+				best = m
+			}
+		}
+
+		return best
+	case StrategyP2C:
+		if len(p.members) == 1 {
+			return p.members[0]
+		}
+
+		i := rand.IntN(len(p.members))
+		j := rand.IntN(len(p.members) - 1)
+		if j >= i {
+			j++
+		}
+
+		a, b := p.members[i], p.members[j]
+		if b.mb.load() < a.mb.load() {
+			return b
+		}
+
+		return a
+	default:
+		return p.rendezvous(key)
+	}
+}
+
+// rendezvous returns the member with the highest score for key.
+func (p *Pool) rendezvous(key string) *member {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+	h := hash.Sum64()
+
+	var best *member
+	var bestScore uint64
+
+	for _, m := range p.members {
+		if score := mix(h ^ m.seed); best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+
+	return best
+}
+
+// mix is the splitmix64 finalizer, cheap enough to run against every member for each key.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+func (p *Pool) Send(name string, msg any) {
+	send(p.engine, p.GetActor(name), msg)
+}
+
+// Broadcast sends msg to every actor of the pool.
+func (p *Pool) Broadcast(msg any) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, m := range p.members {
+		send(p.engine, m.pid, msg)
+	}
+}
+
+// Size returns the number of members.
+func (p *Pool) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.members)
+}
+
+// Loads returns the load of every member.
+func (p *Pool) Loads() []MemberLoad {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	loads := make([]MemberLoad, 0, len(p.members))
+	for _, m := range p.members {
+		loads = append(loads, MemberLoad{Name: m.name, Depth: m.mb.load()})
+	}
+
+	return loads
+}
+
+// Add spawns a new member and returns its PID.
+func (p *Pool) Add() *actor.PID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := fmt.Sprintf("%s-actor-%d", p.kind, p.next)
+	p.next++
+
+	hash := fnv.New64a()
 	_, _ = hash.Write([]byte(name))
-	index := int(hash.Sum32()) % p.size
-	return p.actors[index]
+
+	m := &member{name: name, seed: hash.Sum64()}
+	p.spawn(m)
+	p.members = append(p.members, m)
+
+	metrics.PoolSize.WithLabelValues(p.kind).Set(float64(len(p.members)))
+
+	return m.pid
+}
+
+// Remove takes the most recently added member out of the pool and asks it to drain: it finishes
+// the messages already queued and the work it has in flight, then stops. It keeps at least one
+// member and reports whether one was removed.
+func (p *Pool) Remove() bool {
+	p.mu.Lock()
+
+	if len(p.members) <= 1 {
+		p.mu.Unlock()
+		return false
+	}
+
+	m := p.members[len(p.members)-1]
+	p.members = p.members[:len(p.members)-1]
+	p.draining[m.pid.ID] = m
+	p.next--
+
+	metrics.PoolSize.WithLabelValues(p.kind).Set(float64(len(p.members)))
+	p.mu.Unlock()
+
+	// New messages for its keys already go elsewhere, so Drain is the last message it gets.
+	send(p.engine, m.pid, messages.Drain{})
+
+	return true
+}
+
+// spawn starts the actor of m. Must be called with p.mu held.
+func (p *Pool) spawn(m *member) {
+	m.mb = &mailbox{
+		gauge:       metrics.MailboxDepth.WithLabelValues(p.kind),
+		memberGauge: metrics.PoolMemberDepth.WithLabelValues(p.kind, m.name),
+	}
+
+	opts := append(p.supervision.Opts(p.kind, p.replace), actor.WithInboxSize(p.inboxSize), actor.WithMiddleware(countReceived(m.mb)))
+
+	m.pid = p.engine.Spawn(p.props, m.name, opts...)
+	mailboxes.Store(m.pid.ID, m.mb)
 }
 
-func NewPool(root *actor.Engine, props actor.Producer, kind string, poolSize, inboxSize int) *Pool {
-	pool := &Pool{size: poolSize}
+// replace swaps a member that keeps crashing for a new actor under the same name, so it takes over
+// its keys. The old actor is drained like a removed one.
+func (p *Pool) replace(pid *actor.PID) {
+	p.mu.Lock()
+
+	var old *member
+	for i, m := range p.members {
+		if m.pid.Equals(pid) {
+			old = m
+			p.draining[m.pid.ID] = m
+			p.members[i] = &member{name: m.name, seed: m.seed}
+			p.spawn(p.members[i])
+			break
+		}
+	}
+
+	p.mu.Unlock()
+
+	if old == nil {
+		return
+	}
+
+	send(p.engine, old.pid, messages.Drain{})
 
-	for i := 0; i < poolSize; i++ {
-		name := fmt.Sprintf("%s-actor-%d", kind, i)
+	slog.Error("Pool member replaced", slog.String("pool", p.kind), slog.String("member", old.name), slog.String("pid", old.pid.String()))
+}
+
+// respawn replaces a member that died. Members taken out of the pool on purpose are only
+// forgotten once they stop.
+func (p *Pool) respawn(pid *actor.PID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if m, ok := p.draining[pid.ID]; ok {
+		delete(p.draining, pid.ID)
+		p.forget(m)
+		return
+	}
+
+	for _, m := range p.members {
+		if !m.pid.Equals(pid) {
+			continue
+		}
+
+		mailboxes.Delete(pid.ID)
+
+		// Whatever was still queued died with the actor.
+		m.mb.gauge.Sub(float64(m.mb.depth.Load()))
+		m.mb.memberGauge.Set(0)
+
+		p.spawn(m)
+
+		metrics.PoolRespawns.WithLabelValues(p.kind).Inc()
+		slog.Error("Pool member died, re-spawned", slog.String("pool", p.kind), slog.String("member", m.name), slog.String("pid", m.pid.String()))
+
+		return
+	}
+}
+
+// forget stops counting the messages of a member that stopped after being taken out of the pool.
+// Its name may already belong to a new member, whose gauge is then kept. Must be called with p.mu
+// held.
+func (p *Pool) forget(m *member) {
+	mailboxes.Delete(m.pid.ID)
+
+	left := float64(m.mb.depth.Load())
+	m.mb.gauge.Sub(left)
+
+	for _, live := range p.members {
+		if live.name == m.name {
+			m.mb.memberGauge.Sub(left)
+			return
+		}
+	}
+
+	metrics.PoolMemberDepth.DeleteLabelValues(p.kind, m.name)
+}
+
+// supervise watches the engine events for members that stopped while still in the pool, whether
+// they were stopped from outside or gave up after too many restarts, and for drained members that
+// were taken out of it.
+func (p *Pool) supervise(c *actor.Context) {
+	switch e := c.Message().(type) {
+	case actor.ActorStoppedEvent:
+		p.respawn(e.PID)
+	}
+}
+
+// NewPool creates an empty pool. Its actors are spawned by Start, so actors that need to know
+// the pool can be created in between.
+func NewPool(root *actor.Engine, kind string, inboxSize int, strategy Strategy, supervision Supervision) *Pool {
+	return &Pool{engine: root, kind: kind, inboxSize: inboxSize, strategy: strategy, supervision: supervision, draining: make(map[string]*member)}
+}
 
-		pid := root.Spawn(props, name, actor.WithInboxSize(inboxSize))
+// Start spawns size members from props and the supervisor that re-spawns them.
+func (p *Pool) Start(props actor.Producer, size int) {
+	p.props = props
 
-		pool.actors = append(pool.actors, pid)
+	for i := 0; i < size; i++ {
+		p.Add()
 	}
 
-	return pool
+	p.supervisor = p.engine.SpawnFunc(p.supervise, p.kind+"-supervisor")
+	p.engine.Subscribe(p.supervisor)
 }
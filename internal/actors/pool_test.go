@@ -0,0 +1,246 @@
+package actors
+
+import (
+	"fmt"
+	"github.com/anthdm/hollywood/actor"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"testing"
+	"time"
+)
+
+type idleActor struct{}
+
+func (idleActor) Receive(*actor.Context) {}
+
+// drainingActor stops on Drain once release is closed, like a member finishing its work. It
+// tells drained when it got Drain.
+type drainingActor struct {
+	drained chan struct{}
+	release chan struct{}
+}
+
+func (a drainingActor) Receive(c *actor.Context) {
+	if _, ok := c.Message().(messages.Drain); ok {
+		a.drained <- struct{}{}
+		<-a.release
+		c.Engine().Poison(c.PID())
+	}
+}
+
+func newTestPool(t *testing.T, size int) *Pool {
+	return newTestPoolWith(t, StrategyHash, size)
+}
+
+func newTestPoolWith(t *testing.T, strategy Strategy, size int) *Pool {
+	t.Helper()
+
+	engine, err := actor.NewEngine(actor.NewEngineConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPool(engine, t.Name(), 16, strategy, Supervision{})
+	p.Start(func() actor.Receiver { return idleActor{} }, size)
+
+	return p
+}
+
+// owners returns the member each key is sent to.
+func owners(p *Pool, keys []string) map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	out := make(map[string]string, len(keys))
+	for _, k := range keys {
+		out[k] = p.pick(k).name
+	}
+
+	return out
+}
+
+func TestRendezvousStability(t *testing.T) {
+	keys := make([]string, 10_000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("4a7f3c2e-0000-4000-8000-%012d", i)
+	}
+
+	p := newTestPool(t, 4)
+	before := owners(p, keys)
+
+	if again := owners(p, keys); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Fatal("the same keys went to different members")
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Pool) string
+		// moved reports whether a key may change member, given where it was and the member changed.
+		moved func(from, to, changed string) bool
+	}{
+		{
+			name:   "add",
+			change: func(p *Pool) string { p.Add(); return fmt.Sprintf("%s-actor-4", p.kind) },
+			moved:  func(_, to, added string) bool { return to == added },
+		},
+		{
+			name:   "remove",
+			change: func(p *Pool) string { p.Remove(); return fmt.Sprintf("%s-actor-3", p.kind) },
+			moved:  func(from, _, removed string) bool { return from == removed },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(t, 4)
+			before := owners(p, keys)
+			changed := tt.change(p)
+			after := owners(p, keys)
+
+			moved := 0
+			for _, k := range keys {
+				if before[k] == after[k] {
+					continue
+				}
+
+				moved++
+				if !tt.moved(before[k], after[k], changed) {
+					t.Fatalf("key %s moved from %s to %s, only keys of %s should move", k, before[k], after[k], changed)
+				}
+			}
+
+			// About a fifth of the keys for an added fifth member, a quarter for one of four removed.
+			if moved < len(keys)/8 || moved > len(keys)/3 {
+				t.Errorf("%d of %d keys moved", moved, len(keys))
+			}
+		})
+	}
+}
+
+func TestRendezvousRemoveThenAdd(t *testing.T) {
+	keys := make([]string, 1_000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	p := newTestPool(t, 3)
+	before := owners(p, keys)
+
+	// The member added back takes the name, and so the keys, of the one removed.
+	p.Remove()
+	p.Add()
+
+	if after := owners(p, keys); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Error("keys did not go back to the members they had before")
+	}
+}
+
+func TestPickLeastLoaded(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth []int64
+		work  []int64
+		// least and most are the members with the lowest and highest load.
+		least, most int
+	}{
+		{"queued", []int64{3, 1, 2}, []int64{0, 0, 0}, 1, 0},
+		// Payments waiting in an actor for a call count as much as those still in its mailbox.
+		{"held", []int64{0, 0, 0}, []int64{8, 2, 5}, 1, 0},
+		{"queued and held", []int64{0, 4, 1}, []int64{6, 0, 4}, 1, 0},
+	}
+
+	for _, tt := range tests {
+		for name, strategy := range map[string]Strategy{"least-queued": StrategyLeastQueued, "p2c": StrategyP2C} {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				p := newTestPoolWith(t, strategy, len(tt.depth))
+
+				for i, m := range p.members {
+					m.mb.depth.Store(tt.depth[i])
+					m.mb.work.Store(tt.work[i])
+				}
+
+				picked := make(map[string]int)
+				for range 300 {
+					picked[p.pick("").name]++
+				}
+
+				least, most := p.members[tt.least].name, p.members[tt.most].name
+
+				// p2c picks the least loaded member whenever it draws it and the most loaded never.
+				if picked[least] == 0 || picked[most] > 0 {
+					t.Fatalf("picked %v, want %s and never %s", picked, least, most)
+				}
+
+				if strategy == StrategyLeastQueued && len(picked) != 1 {
+					t.Errorf("picked %v, want only %s", picked, least)
+				}
+
+				want := tt.depth[tt.least] + tt.work[tt.least]
+				if got := p.Loads()[tt.least].Depth; got != want {
+					t.Errorf("got load %d for %s, want %d", got, least, want)
+				}
+			})
+		}
+	}
+}
+
+func TestRemoveCountsUntilStopped(t *testing.T) {
+	engine, err := actor.NewEngine(actor.NewEngineConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drained, release := make(chan struct{}, 1), make(chan struct{})
+	p := NewPool(engine, t.Name(), 16, StrategyHash, Supervision{})
+	p.Start(func() actor.Receiver { return drainingActor{drained: drained, release: release} }, 2)
+
+	removed := p.members[1]
+	p.Remove()
+	<-drained
+
+	// Drain blocks the removed member, so these stay queued on it.
+	for range 3 {
+		send(engine, removed.pid, "queued")
+	}
+
+	if _, ok := mailboxes.Load(removed.pid.ID); !ok {
+		t.Fatal("mailbox of the removed member forgotten while it drains")
+	}
+
+	depth := metrics.MailboxDepth.WithLabelValues(p.kind)
+	if got := testutil.ToFloat64(depth); got != 3 {
+		t.Fatalf("got pool depth %v while draining, want 3", got)
+	}
+
+	close(release)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		p.mu.RLock()
+		_, draining := p.draining[removed.pid.ID]
+		p.mu.RUnlock()
+
+		if !draining {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("removed member not forgotten after it stopped")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := mailboxes.Load(removed.pid.ID); ok {
+		t.Error("mailbox of the stopped member still counted")
+	}
+
+	if got := testutil.ToFloat64(depth); got != 0 {
+		t.Errorf("got pool depth %v after the member stopped, want 0", got)
+	}
+
+	if metrics.PoolMemberDepth.DeleteLabelValues(p.kind, removed.name) {
+		t.Error("gauge of the stopped member still exported")
+	}
+}
@@ -1,19 +1,32 @@
 package actors
 
 import (
+	"errors"
 	"github.com/anthdm/hollywood/actor"
 	goJson "github.com/goccy/go-json"
-	"github.com/rbenatti8/rinha-de-backend-2025/internal/database"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/healthy"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/hedge"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/limiter"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/logging"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
-	"github.com/redis/go-redis/v9"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/outcome"
+	lookup "github.com/rbenatti8/rinha-de-backend-2025/internal/processor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/retry"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/tracing"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
-	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
+// resumeDelay is how long an actor waits before trying again when a processor limiter is full.
+const resumeDelay = 5 * time.Millisecond
+
 var (
 	nonePaymentProcessor     = "none"
 	defaultPaymentProcessor  = "default"
@@ -27,11 +40,22 @@ type PaymentProcessorActor struct {
 	fallbackProcessorURL string
 	bestPaymentProcessor string
 	dbActor              *actor.PID
-	redis                *redis.Client
+	writerActor          *actor.PID
 	retryActorPID        *actor.PID
+	retryBudget          *retry.Budget
+	hedger               *hedge.Hedger
+	baseURLs             map[string]string
 	integrityActorPool   *Pool
 	engine               *actor.Engine
-	db                   *database.DB
+	timeouts             *atomic.Pointer[messages.ProcessorConfigChanged]
+	readTimeout          time.Duration
+	writeTimeout         time.Duration
+	concurrency          int
+	inflight             map[string]struct{}
+	pending              []messages.ProcessPayment
+	limiters             limiter.Set
+	resumeScheduled      bool
+	draining             bool
 }
 
 func (a *PaymentProcessorActor) Receive(c *actor.Context) {
@@ -39,20 +63,98 @@ func (a *PaymentProcessorActor) Receive(c *actor.Context) {
 	case actor.Started:
 		a.engine = c.Engine()
 		a.bestPaymentProcessor = defaultPaymentProcessor
+
+		// Actors started after a reload, or restarted after a crash, did not receive the change.
+		t := a.timeouts.Load()
+		a.readTimeout, a.writeTimeout = t.ReadTimeout, t.WriteTimeout
+	case actor.Stopped:
+		// After a crash the actor restarts under the same PID with an empty state: hand the
+		// payments still waiting for a slot over to the new instance.
+		for _, p := range a.pending {
+			send(c.Engine(), c.PID(), p)
+		}
+
+		// They are queued again, and the calls in flight died with this instance.
+		a.pending = nil
+		clear(a.inflight)
+
+		if a.draining {
+			send(c.Engine(), c.PID(), messages.Drain{})
+		}
+	case messages.ProcessorConfigChanged:
+		a.readTimeout = msg.ReadTimeout
+		a.writeTimeout = msg.WriteTimeout
 	case messages.ProcessPayment:
-		paymentProcessor, err := a.hcChecker.GetPaymentProcessor()
-		if err != nil {
-			a.scheduleRetry(c.PID(), msg)
-			return
+		a.pending = append(a.pending, msg)
+		a.dispatchPending(c)
+	case messages.ProcessorCallCompleted:
+		a.completeCall(c, msg)
+		a.dispatchPending(c)
+		a.stopIfDrained(c)
+	case messages.ResumeDispatch:
+		a.resumeScheduled = false
+		a.dispatchPending(c)
+		a.stopIfDrained(c)
+	case messages.Drain:
+		a.draining = true
+		a.stopIfDrained(c)
+	}
+
+	// Payments wait here rather than in the mailbox, so the pool and its autoscaler are told how
+	// many there are.
+	reportWork(c, len(a.pending)+len(a.inflight))
+}
+
+// stopIfDrained stops an actor removed from its pool once nothing is pending or in flight, so no
+// completion is sent to a stopped actor. Draining is over by then: it is not handed over on Stopped.
+func (a *PaymentProcessorActor) stopIfDrained(c *actor.Context) {
+	if a.draining && len(a.inflight) == 0 && len(a.pending) == 0 {
+		a.draining = false
+		c.Engine().Poison(c.PID())
+	}
+}
+
+// dispatchPending starts the queued payments while there is room for more calls in flight. A
+// payment whose correlationId already has a call in flight waits for it to complete, so attempts
+// for the same payment never overlap and run in the order they were received.
+func (a *PaymentProcessorActor) dispatchPending(c *actor.Context) {
+	kept := a.pending[:0]
+
+	for i, msg := range a.pending {
+		if len(a.inflight) >= a.concurrency {
+			kept = append(kept, a.pending[i:]...)
+			break
 		}
 
-		if paymentProcessor == fallbackPaymentProcessor {
-			a.callProcessor(c, fallbackPaymentProcessor, msg)
-			return
+		if _, busy := a.inflight[msg.Payment.CID]; busy {
+			kept = append(kept, msg)
+			continue
 		}
 
-		a.callProcessor(c, defaultPaymentProcessor, msg)
+		if !a.startCall(c, msg) {
+			kept = append(kept, a.pending[i:]...)
+			break
+		}
 	}
+
+	clear(a.pending[len(kept):])
+	a.pending = kept
+}
+
+// resumeLater wakes the actor up to dispatch its pending payments once the limiter of a processor
+// may have room again. Completions of this actor's own calls do that already, so it is only needed
+// when none are in flight.
+func (a *PaymentProcessorActor) resumeLater(c *actor.Context) {
+	if a.resumeScheduled || len(a.inflight) > 0 {
+		return
+	}
+
+	a.resumeScheduled = true
+	engine, pid := c.Engine(), c.PID()
+
+	time.AfterFunc(resumeDelay, func() {
+		send(engine, pid, messages.ResumeDispatch{})
+	})
 }
 
 func (a *PaymentProcessorActor) hasAvailableProcessor() bool {
@@ -63,141 +165,354 @@ func (a *PaymentProcessorActor) hasAvailableProcessor() bool {
 	return false
 }
 
-func (a *PaymentProcessorActor) callProcessor(c *actor.Context, processor string, msg messages.ProcessPayment) {
-	url := a.defaultProcessorURL
+// startCall sends a payment to the processor chosen by the health checks without waiting for the
+// response, which comes back to the actor as a ProcessorCallCompleted. It reports false, leaving
+// the payment to the caller, when the limiter of that processor has no room.
+func (a *PaymentProcessorActor) startCall(c *actor.Context, msg messages.ProcessPayment) bool {
+	processor, err := a.hcChecker.GetPaymentProcessor()
+	if err != nil {
+		a.scheduleRetry(msg, "", outcome.Result{Outcome: outcome.Unavailable})
+		return true
+	}
 
+	if !a.limiters[processor].Acquire() {
+		a.resumeLater(c)
+		return false
+	}
+
+	url := a.defaultProcessorURL
 	if processor == fallbackPaymentProcessor {
 		url = a.fallbackProcessorURL
 	}
 
 	msg.Payment.RequestedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	msg.Dispatched = msg.Dispatched.With(processor)
 
 	buf, _ := goJson.Marshal(msg.Payment)
 
-	req := fasthttp.AcquireRequest()
-	resp := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseRequest(req)
-	defer fasthttp.ReleaseResponse(resp)
+	span := tracing.Start(msg.Trace, "processor.call",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("payment.correlation_id", msg.Payment.CID),
+			attribute.String("payment.processor", processor),
+			attribute.Int("payment.attempt", msg.Tries),
+		),
+	)
+
+	a.inflight[msg.Payment.CID] = struct{}{}
+
+	engine, pid := c.Engine(), c.PID()
+	timeout := a.writeTimeout + a.readTimeout
+	start := time.Now()
+
+	go func() {
+		res, hedged, running := a.hedgedPost(processor, url, msg.Payment.CID, buf, timeout, span)
+		if running != nil {
+			// The call is still using a connection of the processor, so its slot stays taken until
+			// it ends.
+			go func() {
+				last := <-running
+				a.limiters[processor].Release(time.Since(start), overloaded(last.Outcome))
+			}()
+		} else {
+			a.limiters[processor].Release(time.Since(start), overloaded(res.Outcome))
+		}
 
-	req.SetRequestURI(url)
-	req.Header.SetMethod(fasthttp.MethodPost)
-	req.Header.SetContentType("application/json")
-	req.SetBody(buf)
+		send(engine, pid, messages.ProcessorCallCompleted{Request: msg, Processor: processor, Span: span, Result: res, Hedged: hedged})
+	}()
 
-	err := a.client.Do(req, resp)
-	if isTimeoutErr(err) {
-		slog.Warn("Sending to integrity actor: ", slog.String("cid", msg.Payment.CID), slog.String("RequestedAt", msg.Payment.RequestedAt))
-		a.sendToIntegrityActor(msg, processor)
-		return
+	return true
+}
+
+func (a *PaymentProcessorActor) completeCall(c *actor.Context, m messages.ProcessorCallCompleted) {
+	delete(a.inflight, m.Request.Payment.CID)
+
+	msg, processor, span, res, hedged := m.Request, m.Processor, m.Span, m.Result, m.Hedged
+	defer span.End()
+
+	span.SetAttributes(attribute.String("payment.outcome", res.Outcome.String()), attribute.Bool("payment.hedged", hedged))
+	if res.Err == nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", res.Status))
 	}
 
-	if isErr(msg.Payment, resp, err) {
-		a.scheduleRetry(c.PID(), msg)
-		return
+	switch {
+	case res.Outcome.Processed():
+		if msg.Tries == 0 {
+			a.retryBudget.Success()
+		}
+
+		// A hedged call is expected to find the payment already there.
+		if res.Outcome == outcome.Duplicate && !hedged {
+			logging.Payment(slog.LevelWarn, "Duplicate payment detected", msg.Payment.CID, processor, msg.Tries)
+		}
+
+		c.Send(a.writerActor, messages.PushPayment{
+			Payment:     msg.Payment,
+			ProcessedBy: processor,
+			ProcessedAt: time.Now().UTC(),
+			Tries:       msg.Tries,
+			Trace:       span.SpanContext(),
+		})
+	case res.Outcome.Ambiguous():
+		span.SetStatus(codes.Error, res.Outcome.String())
+		logging.Payment(slog.LevelWarn, "Sending to integrity actor", msg.Payment.CID, processor, msg.Tries, slog.String("requestedAt", msg.Payment.RequestedAt))
+		a.sendToIntegrityActor(msg, processor, span.SpanContext())
+	case res.Outcome.Retryable():
+		span.SetStatus(codes.Error, "retry scheduled")
+		logCallFailure(slog.LevelError, msg, processor, res)
+		a.scheduleRetry(msg, processor, res)
+	default:
+		span.SetStatus(codes.Error, res.Outcome.String())
+		logCallFailure(slog.LevelError, msg, processor, res)
+		c.Send(a.dbActor, messages.DeadLetterPayment{
+			Payment:   msg.Payment,
+			Processor: processor,
+			Reason:    "rejected with status " + strconv.Itoa(res.Status),
+		})
 	}
+}
 
-	a.pushPayment(messages.PushPayment{
-		Payment:     msg.Payment,
-		ProcessedBy: processor,
-		ProcessedAt: time.Now().UTC(),
-	})
+// dropped dead letters a payment whose handling kept crashing the actor, unless the processor may
+// have charged it: a charged payment still goes to the writer, and one that may have been charged
+// to the integrity checks.
+func (a *PaymentProcessorActor) dropped(c *actor.Context, msg any, reason string) {
+	switch m := msg.(type) {
+	case messages.ProcessPayment:
+		c.Send(a.dbActor, messages.DeadLetterPayment{Payment: m.Payment, Reason: reason})
+	case messages.ProcessorCallCompleted:
+		delete(a.inflight, m.Request.Payment.CID)
+		m.Span.End()
+
+		switch {
+		case m.Result.Outcome.Processed():
+			c.Send(a.writerActor, messages.PushPayment{
+				Payment:     m.Request.Payment,
+				ProcessedBy: m.Processor,
+				ProcessedAt: time.Now().UTC(),
+				Tries:       m.Request.Tries,
+				Trace:       m.Span.SpanContext(),
+			})
+			return
+		case m.Result.Outcome.Ambiguous():
+			a.sendToIntegrityActor(m.Request, m.Processor, m.Span.SpanContext())
+			return
+		}
+
+		c.Send(a.dbActor, messages.DeadLetterPayment{
+			Payment:   m.Request.Payment,
+			Processor: m.Processor,
+			Reason:    m.Result.Outcome.String() + ", " + reason,
+		})
+	}
 }
 
-func (a *PaymentProcessorActor) scheduleRetry(sender *actor.PID, msg messages.ProcessPayment) {
-	a.engine.Send(a.retryActorPID, messages.ScheduleRetry{
-		Sender:  sender,
-		Payment: msg.Payment,
-		Tries:   msg.Tries,
-	})
+// overloaded reports whether an outcome hints that the processor is taking more than it can handle.
+func overloaded(o outcome.Outcome) bool {
+	switch o {
+	case outcome.ServerError, outcome.RateLimited, outcome.TimeoutBeforeSend, outcome.TimeoutAfterSend, outcome.ConnectionError:
+		return true
+	}
+
+	return false
 }
 
-func (a *PaymentProcessorActor) sendToIntegrityActor(msg messages.ProcessPayment, processor string) {
-	integrityActor := a.integrityActorPool.GetActor(msg.Payment.CID)
-	a.engine.Send(integrityActor, messages.CheckIntegrity{
-		Payment:   msg.Payment,
-		Processor: processor,
-	})
+// post sends a payment to a processor in the background and delivers the classified result on the
+// returned channel.
+func (a *PaymentProcessorActor) post(processor, url string, body []byte, timeout time.Duration, span trace.Span) <-chan outcome.Result {
+	ch := make(chan outcome.Result, 1)
+
+	go func() {
+		req := fasthttp.AcquireRequest()
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseRequest(req)
+		defer fasthttp.ReleaseResponse(resp)
+
+		req.SetRequestURI(url)
+		req.Header.SetMethod(fasthttp.MethodPost)
+		req.Header.SetContentType("application/json")
+		req.SetBody(body)
+		req.SetTimeout(timeout)
+		tracing.Inject(span, req)
+
+		start := time.Now()
+		err := a.client.Do(req, resp)
+		res := outcome.Classify(resp, err)
+		observeProcessorCall(processor, start, res)
+
+		if err == nil {
+			a.hedger.Observe(processor, time.Since(start))
+		}
+
+		ch <- res
+	}()
+
+	return ch
 }
 
-func (a *PaymentProcessorActor) pushPayment(msg messages.PushPayment) {
-	t := time.Now()
-	bufPtr := bufPool.Get().(*[]byte)
-	buf := (*bufPtr)[:0]
+// hedgedPost sends a payment and, if the call runs past the hedge delay of the processor, sends it
+// a second time to the same processor, which rejects whichever copy comes second as a duplicate.
+// The processor is looked up first: if it already has the payment there is no need to wait, and if
+// the lookup fails nothing more is sent. It reports whether the call was hedged and, when the
+// payment went through before both calls ended, returns the one still running.
+func (a *PaymentProcessorActor) hedgedPost(processor, url, cid string, body []byte, timeout time.Duration, span trace.Span) (outcome.Result, bool, <-chan outcome.Result) {
+	primary := a.post(processor, url, body, timeout, span)
+
+	delay := a.hedger.Delay(processor)
+	if delay == 0 {
+		return <-primary, false, nil
+	}
 
-	buf = append(buf, msg.Payment.CID...)
-	buf = append(buf, '|')
-	buf = strconv.AppendFloat(buf, msg.Payment.Amount, 'f', -1, 64)
-	buf = append(buf, '|')
-	buf = append(buf, msg.Payment.RequestedAt...)
-	buf = append(buf, '|')
-	buf = append(buf, msg.ProcessedBy...)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
 
-	timeToBuildBuf := time.Since(t)
-	if timeToBuildBuf > 30*time.Millisecond {
-		slog.Warn("Slow buffer creation for payment", slog.String("CID", msg.Payment.CID), slog.Duration("duration", timeToBuildBuf))
+	select {
+	case res := <-primary:
+		return res, false, nil
+	case <-timer.C:
 	}
-	timeToArrive := time.Since(msg.ProcessedAt)
-	if timeToArrive > 100*time.Millisecond {
-		slog.Warn("Payment took too long to arrive", slog.String("ActorID", msg.Payment.CID), slog.Duration("time_to_arrive", timeToArrive))
+
+	_, err := lookup.Lookup(a.client, a.baseURLs[processor], cid, a.hedger.LookupTimeout())
+
+	select {
+	case res := <-primary:
+		return res, false, nil
+	default:
 	}
 
-	t = time.Now()
-	err := a.redis.RPush(ctx, keyPaymentsAll, string(buf)).Err()
-	if err != nil {
-		slog.Error("Error pushing payments to Redis", slog.String("error", err.Error()))
+	switch {
+	case err == nil:
+		metrics.HedgedCalls.WithLabelValues(processor, "found_by_lookup").Inc()
+		return outcome.Result{Outcome: outcome.Duplicate, Status: fasthttp.StatusUnprocessableEntity}, true, primary
+	case !errors.Is(err, lookup.ErrNotFound):
+		metrics.HedgedCalls.WithLabelValues(processor, "lookup_failed").Inc()
+		return <-primary, false, nil
 	}
 
-	if time.Since(t) > 100*time.Millisecond {
-		slog.Warn("Slow push to Redis", slog.String("CID", msg.Payment.CID), slog.Duration("duration", time.Since(t)))
+	metrics.HedgedCalls.WithLabelValues(processor, "hedged").Inc()
+	hedge := a.post(processor, url, body, timeout, span)
+
+	var first outcome.Result
+	for i := 0; i < 2; i++ {
+		var res outcome.Result
+		won := "primary_won"
+
+		select {
+		case res = <-primary:
+			primary = nil
+		case res = <-hedge:
+			hedge = nil
+			won = "hedge_won"
+		}
+
+		if res.Outcome.Processed() {
+			metrics.HedgedCalls.WithLabelValues(processor, won).Inc()
+
+			running := primary
+			if running == nil {
+				running = hedge
+			}
+
+			return res, true, running
+		}
+
+		if i == 0 {
+			first = res
+			continue
+		}
+
+		// Neither copy went through. If one of them may still have been charged, the payment
+		// has to go through the integrity checks.
+		if res.Outcome.Ambiguous() {
+			return res, true, nil
+		}
 	}
 
-	bufPool.Put(bufPtr)
+	return first, true, nil
 }
 
-func isTimeoutErr(err error) bool {
-	if err != nil && err.Error() == "timeout" {
-		return true
-	}
+func (a *PaymentProcessorActor) scheduleRetry(msg messages.ProcessPayment, processor string, res outcome.Result) {
+	a.engine.Send(a.retryActorPID, messages.ScheduleRetry{
+		Payment:    msg.Payment,
+		Tries:      msg.Tries,
+		Dispatched: msg.Dispatched,
+		Processor:  processor,
+		Outcome:    res.Outcome,
+		Backoff:    msg.Backoff,
+		RetryAfter: res.RetryAfter,
+		Trace:      msg.Trace,
+	})
+}
 
-	return false
+func (a *PaymentProcessorActor) sendToIntegrityActor(msg messages.ProcessPayment, processor string, sc trace.SpanContext) {
+	a.integrityActorPool.Send(msg.Payment.CID, messages.CheckIntegrity{
+		Payment:    msg.Payment,
+		Processor:  processor,
+		Dispatched: msg.Dispatched,
+		Tries:      msg.Tries,
+		Trace:      sc,
+	})
 }
 
-func isErr(payment messages.Payment, resp *fasthttp.Response, err error) bool {
-	if err != nil {
-		slog.Error(err.Error())
-		return true
+func observeProcessorCall(processor string, start time.Time, res outcome.Result) {
+	elapsed := time.Since(start)
+	metrics.ProcessorCallDuration.WithLabelValues(processor).Observe(elapsed.Seconds())
+	callLatency.observe(elapsed)
+
+	status := res.Outcome.String()
+	if res.Err == nil {
+		status = strconv.Itoa(res.Status)
 	}
 
-	if resp.StatusCode() == http.StatusUnprocessableEntity {
-		slog.Warn("Duplicate payment detected", slog.String("cid", payment.CID), slog.String("time", time.Now().UTC().Format(time.RFC3339Nano)))
-		return false
+	metrics.ProcessorCalls.WithLabelValues(processor, status).Inc()
+}
+
+func logCallFailure(level slog.Level, msg messages.ProcessPayment, processor string, res outcome.Result) {
+	attrs := []slog.Attr{slog.String("outcome", res.Outcome.String())}
+	if res.Err != nil {
+		attrs = append(attrs, slog.String("error", res.Err.Error()))
+	} else {
+		attrs = append(attrs, slog.Int("code", res.Status))
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		slog.Error("Invalid status code: ", slog.Int("code", resp.StatusCode()))
-		return true
+	if res.RetryAfter > 0 {
+		attrs = append(attrs, slog.Duration("retryAfter", res.RetryAfter))
 	}
 
-	return false
+	logging.Payment(level, "Processor call failed", msg.Payment.CID, processor, msg.Tries, attrs...)
 }
 
 func NewPaymentProcessorActor(
 	client *fasthttp.Client,
 	defaultURL, fallbackURL string,
-	redis *redis.Client,
-	retryActorPID *actor.PID,
+	dbActor, writerActor, retryActorPID *actor.PID,
+	retryBudget *retry.Budget,
+	hedger *hedge.Hedger,
+	limiters limiter.Set,
 	integrityActorPool *Pool,
 	hcChecker *healthy.Checker,
+	timeouts *atomic.Pointer[messages.ProcessorConfigChanged],
+	concurrency int,
 ) actor.Producer {
 	return func() actor.Receiver {
 		return &PaymentProcessorActor{
 			client:               client,
 			defaultProcessorURL:  defaultURL + "/payments",
 			fallbackProcessorURL: fallbackURL + "/payments",
-			redis:                redis,
+			writerActor:          writerActor,
+			dbActor:              dbActor,
 			retryActorPID:        retryActorPID,
-			integrityActorPool:   integrityActorPool,
-			hcChecker:            hcChecker,
+			retryBudget:          retryBudget,
+			hedger:               hedger,
+			limiters:             limiters,
+			baseURLs: map[string]string{
+				defaultPaymentProcessor:  defaultURL,
+				fallbackPaymentProcessor: fallbackURL,
+			},
+			integrityActorPool: integrityActorPool,
+			hcChecker:          hcChecker,
+			timeouts:           timeouts,
+			concurrency:        concurrency,
+			inflight:           make(map[string]struct{}, concurrency),
 		}
 	}
 }
@@ -0,0 +1,49 @@
+package actors
+
+import (
+	"github.com/anthdm/hollywood/actor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"log/slog"
+	"time"
+)
+
+const retentionTimeout = 5 * time.Minute
+
+// StartRetention asks maintenanceActor, every interval, to archive the payments requested more than
+// age ago and, if dropAfter is set, to drop the archives older than that.
+func StartRetention(engine *actor.Engine, maintenanceActor *actor.PID, interval, age, dropAfter time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			now := time.Now()
+
+			if err := retain(engine, maintenanceActor, messages.ArchivePayments{Before: now.Add(-age)}); err != nil {
+				slog.Error("Error archiving payments", slog.String("error", err.Error()))
+				continue
+			}
+
+			if dropAfter == 0 {
+				continue
+			}
+
+			if err := retain(engine, maintenanceActor, messages.DropArchives{Before: now.Add(-dropAfter)}); err != nil {
+				slog.Error("Error dropping archives", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+func retain(engine *actor.Engine, maintenanceActor *actor.PID, msg any) error {
+	res, err := engine.Request(maintenanceActor, msg, retentionTimeout).Result()
+	if err != nil {
+		return err
+	}
+
+	if err, ok := res.(error); ok {
+		return err
+	}
+
+	return nil
+}
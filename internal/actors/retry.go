@@ -3,34 +3,97 @@ package actors
 import (
 	"github.com/anthdm/hollywood/actor"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/healthy"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/logging"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
-	"math/rand"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/outcome"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/retry"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sync/atomic"
 	"time"
 )
 
 type RetryActor struct {
-	heap            *RetryHeap
-	repeater        actor.SendRepeater
-	hcChecker       *healthy.Checker
-	engine          *actor.Engine
-	retryTime       int
-	maxBackoffDelay int
+	heap          *RetryHeap
+	repeater      actor.SendRepeater
+	hcChecker     *healthy.Checker
+	engine        *actor.Engine
+	dbActor       *actor.PID
+	processorPool *Pool
+	config        *atomic.Pointer[messages.RetryConfigChanged]
+	retryTime     time.Duration
+	policies      retry.Policies
+	budget        *retry.Budget
+	pacer         *retry.Pacer
 }
 
 func (r *RetryActor) Receive(c *actor.Context) {
 	switch msg := c.Message().(type) {
 	case actor.Started:
 		r.engine = c.Engine()
-		r.repeater = c.SendRepeat(c.PID(), messages.Retry{}, time.Duration(r.retryTime)*time.Millisecond)
+
+		// A restart after a crash must not fall back to the settings the actor was spawned with.
+		cfg := r.config.Load()
+		r.retryTime, r.policies = cfg.Interval, cfg.Policies
+		r.repeater = c.SendRepeat(c.PID(), messages.Retry{}, r.retryTime)
+	case actor.Stopped:
+		// After a crash the actor restarts under the same PID with an empty heap and a ticker of its
+		// own: stop this one's and hand the retries still waiting over to the new instance.
+		r.repeater.Stop()
+
+		for r.heap.Len() > 0 {
+			item, _ := r.heap.Pop()
+			send(c.Engine(), c.PID(), item)
+		}
+	case RetryItem:
+		r.heap.Push(msg)
+		metrics.RetryHeapSize.Set(float64(r.heap.Len()))
+	case messages.RetryConfigChanged:
+		r.policies = msg.Policies
+
+		if msg.Interval != r.retryTime {
+			r.retryTime = msg.Interval
+			r.repeater.Stop()
+			r.repeater = c.SendRepeat(c.PID(), messages.Retry{}, r.retryTime)
+		}
 	case messages.ScheduleRetry:
-		nextTry := time.Now().UTC().Add(backoff(msg.Tries, r.maxBackoffDelay))
+		policy := r.policies.For(msg.Processor, msg.Outcome)
+
+		// No call was made while waiting for a processor, paused or in its grace period, so it
+		// is not an attempt: however long it lasts, it must not use up the policy's.
+		waiting := msg.Outcome == outcome.Unavailable
+
+		// Tries counts the retries already made, so the failed attempt was number Tries+1.
+		if !waiting && policy.Exhausted(msg.Tries+1) {
+			r.giveUp(c, msg)
+			return
+		}
+
+		// A processor asking us to wait longer than the policy wins over it.
+		delay := max(policy.Delay(msg.Tries+1, msg.Backoff), msg.RetryAfter)
+		nextTry := time.Now().UTC().Add(delay)
 
 		r.heap.Push(RetryItem{
-			Sender:  msg.Sender,
-			Payment: msg.Payment,
-			Tries:   msg.Tries,
-			NextTry: nextTry,
+			Payment:    msg.Payment,
+			Tries:      msg.Tries,
+			Waiting:    waiting,
+			Dispatched: msg.Dispatched,
+			Backoff:    delay,
+			NextTry:    nextTry,
+			Trace:      msg.Trace,
+			Span: tracing.Start(msg.Trace, "retry.wait", trace.WithAttributes(
+				attribute.String("payment.correlation_id", msg.Payment.CID),
+				attribute.Int("payment.attempt", msg.Tries),
+				attribute.String("payment.outcome", msg.Outcome.String()),
+			)),
 		})
+
+		metrics.RetriesScheduled.Inc()
+		logging.Payment(slog.LevelDebug, "Retry scheduled", msg.Payment.CID, msg.Processor, msg.Tries, slog.String("outcome", msg.Outcome.String()), slog.Time("nextTry", nextTry))
+		metrics.RetryHeapSize.Set(float64(r.heap.Len()))
 	case messages.Retry:
 		if !r.hcChecker.HasHealthyProcessors() {
 			return
@@ -44,21 +107,53 @@ func (r *RetryActor) Receive(c *actor.Context) {
 				break
 			}
 
+			// Due items left on the heap are picked up again on the next tick.
+			if !r.pacer.Allow() {
+				metrics.RetriesDeferred.WithLabelValues("paced").Inc()
+				break
+			}
+
+			// The retry does not go out, so it must not use up the pace of the next one.
+			if !r.budget.Withdraw() {
+				r.pacer.Return()
+				metrics.RetriesDeferred.WithLabelValues("budget").Inc()
+				break
+			}
+
 			item, _ = r.heap.Pop()
+			item.Span.End()
 
-			r.engine.Send(item.Sender, messages.ProcessPayment{
-				Payment: item.Payment,
-				Tries:   item.Tries + 1,
+			tries := item.Tries
+			if !item.Waiting {
+				tries++
+			}
+
+			r.processorPool.Send(item.Payment.CID, messages.ProcessPayment{
+				Payment:    item.Payment,
+				Tries:      tries,
+				Dispatched: item.Dispatched,
+				Backoff:    item.Backoff,
+				Trace:      item.Trace,
 			})
+
+			metrics.RetriesFired.Inc()
 		}
+
+		metrics.RetryHeapSize.Set(float64(r.heap.Len()))
+		metrics.RetryBudgetAvailable.Set(r.budget.Available())
 	}
 }
 
 type RetryItem struct {
-	Sender  *actor.PID
 	Payment messages.Payment
 	NextTry time.Time
 	Tries   int
+	// Waiting is set when the payment was not sent anywhere, so the retry is not a new attempt.
+	Waiting    bool
+	Dispatched messages.Dispatched
+	Backoff    time.Duration
+	Trace      trace.SpanContext
+	Span       trace.Span
 }
 
 type RetryHeap struct {
@@ -136,35 +231,41 @@ func (h *RetryHeap) swap(i, j int) {
 	h.items[i], h.items[j] = h.items[j], h.items[i]
 }
 
-func backoff(attempt int, maxDelay int) time.Duration {
-	if attempt < 1 {
-		attempt = 1
-	}
-
-	base := 30
-	mult := 1 << (attempt - 1)
-	delay := base * mult
-
-	jitter := rand.Intn(base)
-
-	total := delay + jitter
-
-	if total > maxDelay {
-		total = maxDelay
-	}
+func (r *RetryActor) giveUp(c *actor.Context, msg messages.ScheduleRetry) {
+	logging.Payment(slog.LevelError, "Retry attempts exhausted, dead lettering payment", msg.Payment.CID, msg.Processor, msg.Tries, slog.String("outcome", msg.Outcome.String()))
 
-	return time.Duration(total) * time.Millisecond
+	c.Send(r.dbActor, messages.DeadLetterPayment{
+		Payment:   msg.Payment,
+		Processor: msg.Processor,
+		Reason:    "retries exhausted after " + msg.Outcome.String(),
+	})
 }
 
-func NewRetryActor(retryTime int, maxBackoffDelay int, heapSize int, hcChecker *healthy.Checker) actor.Producer {
+// NewRetryActor creates the retry actor. Due retries are drained from the heap at most drainRate
+// per second and only while budget allows them; budget is shared with the processor actors, which
+// report the successful first attempts it is based on. Retries go through processorPool rather than
+// back to the actor that failed, which may have been removed or replaced in the meantime. config
+// holds the current interval and policies, kept up to date by the reloader.
+func NewRetryActor(
+	config *atomic.Pointer[messages.RetryConfigChanged],
+	budget *retry.Budget,
+	drainRate float64,
+	heapSize int,
+	dbActor *actor.PID,
+	processorPool *Pool,
+	hcChecker *healthy.Checker,
+) actor.Producer {
 	return func() actor.Receiver {
 		return &RetryActor{
 			heap: &RetryHeap{
 				items: make([]RetryItem, 0, heapSize),
 			},
-			retryTime:       retryTime,
-			maxBackoffDelay: maxBackoffDelay,
-			hcChecker:       hcChecker,
+			config:        config,
+			budget:        budget,
+			pacer:         retry.NewPacer(drainRate, max(1, int(drainRate*config.Load().Interval.Seconds()))),
+			dbActor:       dbActor,
+			processorPool: processorPool,
+			hcChecker:     hcChecker,
 		}
 	}
 }
@@ -0,0 +1,149 @@
+package actors
+
+import (
+	"fmt"
+	"github.com/anthdm/hollywood/actor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"log/slog"
+	"math"
+	"runtime/debug"
+	"time"
+)
+
+// Supervision is the crash policy of an actor. hollywood restarts a crashed actor with a fresh
+// receiver but drops the message it was handling, and once its own restart limit is reached it
+// stops the actor through a path that panics on a nil cancel func, taking the process down. So the
+// limit is put out of reach and crashes are handled by a middleware instead: the message is
+// delivered again, the restart is delayed with an exponential backoff, and an actor that crashes
+// too often within a window is escalated.
+type Supervision struct {
+	// MaxRestarts is the number of crashes tolerated within Window before escalating.
+	MaxRestarts int
+	Window      time.Duration
+	// MinBackoff and MaxBackoff bound the pause before a restart, doubled with each crash in the
+	// window.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRedeliveries is how many times a message that crashed the actor is delivered again before
+	// it is dropped.
+	MaxRedeliveries int
+}
+
+// Opts returns the spawn options that put an actor under s. kind names the actor in logs and
+// metrics. escalate is called with the actor's PID when it crashes too often; with no escalate the
+// actor just keeps restarting, at up to MaxBackoff.
+func (s Supervision) Opts(kind string, escalate func(*actor.PID)) []actor.OptFunc {
+	cr := &crashes{kind: kind, supervision: s, escalate: escalate, redeliveries: make(map[string]int)}
+
+	return []actor.OptFunc{
+		actor.WithMaxRestarts(math.MaxInt32),
+		actor.WithRestartDelay(0),
+		actor.WithMiddleware(cr.supervise),
+	}
+}
+
+// dropper is implemented by actors whose messages must not vanish when they are dropped for
+// crashing the actor too many times.
+type dropper interface {
+	dropped(c *actor.Context, msg any, reason string)
+}
+
+// crashes is the crash history of one actor. It belongs to the middleware, so it outlives the
+// receivers hollywood creates on each restart. Only the actor's own goroutine touches it.
+type crashes struct {
+	kind        string
+	supervision Supervision
+	escalate    func(*actor.PID)
+
+	windowStart  time.Time
+	count        int
+	escalated    bool
+	redeliveries map[string]int
+}
+
+func (cr *crashes) supervise(next actor.ReceiveFunc) actor.ReceiveFunc {
+	return func(c *actor.Context) {
+		defer func() {
+			if v := recover(); v != nil {
+				cr.crashed(c, v)
+
+				// Let hollywood restart the actor, so it goes on with a fresh state.
+				panic(v)
+			}
+		}()
+
+		next(c)
+	}
+}
+
+func (cr *crashes) crashed(c *actor.Context, reason any) {
+	now := time.Now()
+	if now.Sub(cr.windowStart) > cr.supervision.Window {
+		cr.windowStart = now
+		cr.count = 0
+		cr.escalated = false
+		clear(cr.redeliveries)
+	}
+
+	cr.count++
+	metrics.ActorCrashes.WithLabelValues(cr.kind).Inc()
+
+	msg := c.Message()
+	slog.Error("Actor crashed",
+		slog.String("actor", cr.kind),
+		slog.String("pid", c.PID().String()),
+		slog.String("message", fmt.Sprintf("%T", msg)),
+		slog.String("panic", fmt.Sprint(reason)),
+		slog.Int("crashes", cr.count),
+		slog.String("stack", string(debug.Stack())),
+	)
+
+	switch msg.(type) {
+	case actor.Initialized, actor.Started, actor.Stopped:
+	default:
+		cr.redeliver(c, msg, reason)
+	}
+
+	if cr.count > cr.supervision.MaxRestarts && !cr.escalated {
+		cr.escalated = true
+		metrics.ActorEscalations.WithLabelValues(cr.kind).Inc()
+		slog.Error("Actor crashing too often, escalating", slog.String("actor", cr.kind), slog.String("pid", c.PID().String()),
+			slog.Int("crashes", cr.count), slog.Duration("window", cr.supervision.Window))
+
+		if cr.escalate != nil {
+			cr.escalate(c.PID())
+		}
+	}
+
+	time.Sleep(cr.backoff())
+}
+
+// redeliver puts the message that crashed the actor back in its mailbox, unless it already did so
+// too many times. Messages are told apart by their content, which is only computed on a crash.
+func (cr *crashes) redeliver(c *actor.Context, msg any, reason any) {
+	key := fmt.Sprintf("%T%+v", msg, msg)
+
+	cr.redeliveries[key]++
+	if cr.redeliveries[key] <= cr.supervision.MaxRedeliveries {
+		metrics.CrashedMessages.WithLabelValues(cr.kind, "redelivered").Inc()
+		resend(c, msg)
+		return
+	}
+
+	delete(cr.redeliveries, key)
+	metrics.CrashedMessages.WithLabelValues(cr.kind, "dropped").Inc()
+	slog.Error("Dropping message that keeps crashing the actor", slog.String("actor", cr.kind), slog.String("message", fmt.Sprintf("%T", msg)))
+
+	if d, ok := c.Receiver().(dropper); ok {
+		d.dropped(c, msg, fmt.Sprint("crashed the actor: ", reason))
+	}
+}
+
+func (cr *crashes) backoff() time.Duration {
+	d := cr.supervision.MinBackoff
+	for i := 1; i < cr.count && d < cr.supervision.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, cr.supervision.MaxBackoff)
+}
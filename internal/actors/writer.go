@@ -0,0 +1,265 @@
+package actors
+
+import (
+	"context"
+	"github.com/anthdm/hollywood/actor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/logging"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/spill"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/storage"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"time"
+)
+
+// WriterConfig controls how the writer actor batches payments.
+type WriterConfig struct {
+	// BatchSize is the number of payments that triggers a write; fewer are written after Window.
+	BatchSize int
+	Window    time.Duration
+	// Pipelines is the number of batches written at the same time.
+	Pipelines int
+	// RetryBase and RetryMax bound the delay before spilled payments are written again, doubled
+	// with each failed attempt.
+	RetryBase time.Duration
+	RetryMax  time.Duration
+}
+
+// WriterActor stores processed payments. It coalesces them into batches and writes up to Pipelines
+// batches at once without waiting for each other. A batch that fails goes to the spill buffer,
+// which is written back with a backoff until the store takes it. Writes are idempotent, so a batch
+// that was stored before failing is not stored twice.
+type WriterActor struct {
+	store          storage.Store
+	spill          *spill.Buffer
+	cfg            WriterConfig
+	batch          []messages.PushPayment
+	ready          []writeBatch
+	writing        int
+	flushScheduled bool
+	drainScheduled bool
+	drainFailures  int
+}
+
+// writeBatch is a batch waiting for a free pipeline.
+type writeBatch struct {
+	payments []messages.PushPayment
+	spilled  bool
+}
+
+func (a *WriterActor) Receive(c *actor.Context) {
+	switch m := c.Message().(type) {
+	case actor.Started:
+		if a.spill.Len() > 0 {
+			a.scheduleDrain(c, 0)
+		}
+	case actor.Stopped:
+		// After a crash the actor restarts under the same PID with an empty state: keep what is
+		// not written yet in the spill buffer, which the new instance drains when it starts.
+		a.spillPayments(a.batch)
+		for _, w := range a.ready {
+			a.spillPayments(w.payments)
+		}
+	case messages.PushPayment:
+		a.batch = append(a.batch, m)
+
+		if len(a.batch) >= a.cfg.BatchSize {
+			a.cut()
+		} else if !a.flushScheduled {
+			a.flushScheduled = true
+			engine, pid := c.Engine(), c.PID()
+
+			time.AfterFunc(a.cfg.Window, func() {
+				send(engine, pid, messages.FlushPayments{})
+			})
+		}
+
+		a.write(c)
+	case messages.FlushPayments:
+		a.flushScheduled = false
+		a.cut()
+		a.write(c)
+	case messages.DrainSpill:
+		a.drainScheduled = false
+		a.drain(c)
+	case messages.PaymentsWritten:
+		a.writing = max(0, a.writing-1)
+		a.written(c, m)
+		a.write(c)
+	}
+}
+
+// cut closes the current batch, leaving it to be written.
+func (a *WriterActor) cut() {
+	if len(a.batch) == 0 {
+		return
+	}
+
+	a.ready = append(a.ready, writeBatch{payments: a.batch})
+	a.batch = make([]messages.PushPayment, 0, a.cfg.BatchSize)
+}
+
+// write starts writing the ready batches while there is a free pipeline.
+func (a *WriterActor) write(c *actor.Context) {
+	engine, pid := c.Engine(), c.PID()
+
+	for a.writing < a.cfg.Pipelines && len(a.ready) > 0 {
+		w := a.ready[0]
+		a.ready[0] = writeBatch{}
+		a.ready = a.ready[1:]
+		a.writing++
+
+		go func() {
+			stored, err := a.storeBatch(w.payments)
+			send(engine, pid, messages.PaymentsWritten{Batch: w.payments, Spilled: w.spilled, Stored: stored, Err: err})
+		}()
+	}
+}
+
+func (a *WriterActor) storeBatch(batch []messages.PushPayment) ([]bool, error) {
+	start := time.Now()
+	stored, err := a.store.Store(context.Background(), batch)
+	metrics.WriterBatchDuration.Observe(time.Since(start).Seconds())
+
+	return stored, err
+}
+
+// written acknowledges each payment of a batch that went through, or spills the batch.
+func (a *WriterActor) written(c *actor.Context, m messages.PaymentsWritten) {
+	if m.Err != nil {
+		metrics.WriterBatches.WithLabelValues("failed").Inc()
+		a.spillPayments(m.Batch)
+
+		if m.Spilled {
+			a.drainFailures++
+		}
+
+		delay := a.cfg.RetryBase
+		for i := 0; i < a.drainFailures && delay < a.cfg.RetryMax; i++ {
+			delay *= 2
+		}
+
+		delay = min(delay, a.cfg.RetryMax)
+
+		slog.Error("Error writing payments, spilled",
+			slog.Int("count", len(m.Batch)),
+			slog.Int("spilled", a.spill.Len()),
+			slog.Duration("retryIn", delay),
+			slog.String("error", m.Err.Error()),
+		)
+
+		a.scheduleDrain(c, delay)
+
+		return
+	}
+
+	metrics.WriterBatches.WithLabelValues("written").Inc()
+	metrics.WriterBatchSize.Observe(float64(len(m.Batch)))
+
+	if m.Spilled {
+		a.drainFailures = 0
+
+		if a.spill.Len() > 0 {
+			a.scheduleDrain(c, 0)
+		} else {
+			slog.Warn("Spilled payments all stored")
+		}
+	}
+
+	for i, msg := range m.Batch {
+		span := tracing.Start(msg.Trace, "storage.push", trace.WithAttributes(
+			attribute.String("payment.correlation_id", msg.Payment.CID),
+			attribute.Bool("storage.spilled", m.Spilled),
+		))
+
+		result := "stored"
+		if i < len(m.Stored) && !m.Stored[i] {
+			result = "duplicate"
+			span.SetStatus(codes.Error, "already stored")
+			logging.Payment(slog.LevelWarn, "Payment already stored, skipped", msg.Payment.CID, msg.ProcessedBy, msg.Tries)
+		}
+
+		metrics.WrittenPayments.WithLabelValues(result).Inc()
+
+		if timeToStore := time.Since(msg.ProcessedAt); timeToStore > 100*time.Millisecond && !m.Spilled {
+			logging.Payment(slog.LevelWarn, "Payment took too long to be stored", msg.Payment.CID, msg.ProcessedBy, msg.Tries, slog.Duration("time_to_store", timeToStore))
+		}
+
+		span.End()
+	}
+}
+
+func (a *WriterActor) spillPayments(payments []messages.PushPayment) {
+	if len(payments) == 0 {
+		return
+	}
+
+	if err := a.spill.Push(payments); err != nil {
+		slog.Error("Error spilling payments to disk, keeping them in memory", slog.Int("count", len(payments)), slog.String("error", err.Error()))
+	}
+}
+
+func (a *WriterActor) scheduleDrain(c *actor.Context, delay time.Duration) {
+	if a.drainScheduled {
+		return
+	}
+
+	a.drainScheduled = true
+	engine, pid := c.Engine(), c.PID()
+
+	time.AfterFunc(delay, func() {
+		send(engine, pid, messages.DrainSpill{})
+	})
+}
+
+// drain takes a batch out of the spill buffer to be written again. The next one is taken once it
+// is stored, so while the store is still down only one batch at a time is tried.
+func (a *WriterActor) drain(c *actor.Context) {
+	payments, err := a.spill.Take(a.cfg.BatchSize)
+	if err != nil {
+		slog.Error("Error reading spilled payments", slog.String("error", err.Error()))
+		a.scheduleDrain(c, a.cfg.RetryMax)
+	}
+
+	if len(payments) == 0 {
+		return
+	}
+
+	a.ready = append(a.ready, writeBatch{payments: payments, spilled: true})
+	a.write(c)
+}
+
+// dropped spills the payments of a batch whose handling kept crashing the actor. They were charged,
+// so they must still end up stored.
+func (a *WriterActor) dropped(c *actor.Context, msg any, _ string) {
+	var batch []messages.PushPayment
+
+	switch m := msg.(type) {
+	case messages.PushPayment:
+		batch = []messages.PushPayment{m}
+	case messages.PaymentsWritten:
+		if m.Err == nil {
+			return
+		}
+
+		batch = m.Batch
+	}
+
+	a.spillPayments(batch)
+	a.scheduleDrain(c, a.cfg.RetryBase)
+}
+
+func NewWriterActor(store storage.Store, spill *spill.Buffer, cfg WriterConfig) actor.Producer {
+	return func() actor.Receiver {
+		return &WriterActor{
+			store: store,
+			spill: spill,
+			cfg:   cfg,
+			batch: make([]messages.PushPayment, 0, cfg.BatchSize),
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	if errs := Default().Validate(); len(errs) > 0 {
+		t.Fatalf("default config is invalid: %v", errs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string
+	}{
+		{"port out of range", func(c *Config) { c.Server.Port = 70000 }, "server.port"},
+		{"unknown storage backend", func(c *Config) { c.Storage.Backend = "sqlite" }, "storage.backend"},
+		{"file backend without dir", func(c *Config) { c.Storage.Backend, c.Storage.Dir = "file", "" }, "storage.dir"},
+		{"more pipelines than redis connections", func(c *Config) { c.Writer.Pipelines = c.Redis.PoolSize + 1 }, "writer.pipelines"},
+		{"postgres without dsn", func(c *Config) { c.Storage.Backend, c.Postgres.DSN = "postgres", "" }, "postgres.dsn"},
+		{"retention without archives", func(c *Config) { c.Storage.Backend, c.Storage.Dir, c.Retention.Interval = "file", "data", time.Hour }, "retention.interval"},
+		{"retry max below base", func(c *Config) { c.Writer.RetryMax = c.Writer.RetryBase / 2 }, "writer.retryMax"},
+		{"unknown pool strategy", func(c *Config) { c.Pools.ProcessorStrategy = "random" }, "pools.processorStrategy"},
+		{"limiter initial above max", func(c *Config) { c.Limiter.Initial = c.Limiter.Max + 1 }, "limiter.initial"},
+		{"invalid retry policy", func(c *Config) { c.Retry.Policies = "nonsense" }, "retry:"},
+		{"unknown log level", func(c *Config) { c.Log.Level = "trace" }, "log.level"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.change(&cfg)
+
+			errs := cfg.Validate()
+			if len(errs) != 1 {
+				t.Fatalf("got %d errors, want 1: %v", len(errs), errs)
+			}
+
+			if !strings.HasPrefix(errs[0].Error(), tt.want) {
+				t.Errorf("got %q, want an error about %s", errs[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{raw: "250", want: 250 * time.Millisecond},
+		{raw: "0", want: 0},
+		{raw: "250ms", want: 250 * time.Millisecond},
+		{raw: "2s", want: 2 * time.Second},
+		{raw: "1m30s", want: 90 * time.Second},
+		{raw: "1.5", wantErr: true},
+		{raw: "2 seconds", wantErr: true},
+		{raw: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseDuration(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, want an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		check   func(*testing.T, Config)
+		wantErr []string
+	}{
+		{
+			name:    "bare integers are milliseconds",
+			content: "processors:\n  readTimeout: 1500\n  writeTimeout: 2s\n",
+			check: func(t *testing.T, c Config) {
+				if c.Processors.ReadTimeout != 1500*time.Millisecond || c.Processors.WriteTimeout != 2*time.Second {
+					t.Errorf("got %s and %s", c.Processors.ReadTimeout, c.Processors.WriteTimeout)
+				}
+			},
+		},
+		{
+			name:    "unknown keys are rejected",
+			content: "server:\n  prot: 8080\nwriterr:\n  batchSize: 10\n",
+			wantErr: []string{"server.prot", "writerr.batchSize"},
+		},
+		{
+			name:    "invalid values are reported",
+			content: "server:\n  port: eighty\nwriter:\n  window: soon\n",
+			wantErr: []string{"server.port", "writer.window"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := Default()
+			errs := loadFile(&cfg, path)
+
+			if len(errs) != len(tt.wantErr) {
+				t.Fatalf("got %d errors, want %d: %v", len(errs), len(tt.wantErr), errs)
+			}
+
+			for _, want := range tt.wantErr {
+				found := false
+				for _, err := range errs {
+					found = found || strings.HasPrefix(err.Error(), want+" ")
+				}
+
+				if !found {
+					t.Errorf("no error about %s in %v", want, errs)
+				}
+			}
+
+			if tt.check != nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("server:\n  port: 8080\nwriter:\n  window: 5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PORT", "9090")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.Server.Port != 9090 {
+		t.Errorf("got port %d, want the environment's 9090", cfg.Server.Port)
+	}
+
+	if cfg.Writer.Window != 5*time.Millisecond {
+		t.Errorf("got window %s, want the file's 5ms", cfg.Writer.Window)
+	}
+}
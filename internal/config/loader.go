@@ -0,0 +1,179 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field is a settable leaf of Config together with where its value may come from.
+type field struct {
+	path  string
+	env   string
+	value reflect.Value
+}
+
+func fields(cfg *Config) []field {
+	var out []field
+	collect(reflect.ValueOf(cfg).Elem(), "", &out)
+	return out
+}
+
+func collect(v reflect.Value, prefix string, out *[]field) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		path := sf.Tag.Get("yaml")
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		if sf.Type.Kind() == reflect.Struct && sf.Type != durationType {
+			collect(v.Field(i), path, out)
+			continue
+		}
+
+		*out = append(*out, field{path: path, env: sf.Tag.Get("env"), value: v.Field(i)})
+	}
+}
+
+func loadEnv(cfg *Config, lookup func(string) (string, bool)) []error {
+	var errs []error
+
+	for _, f := range fields(cfg) {
+		if f.env == "" {
+			continue
+		}
+
+		raw, ok := lookup(f.env)
+		if !ok {
+			continue
+		}
+
+		if err := set(f.value, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s=%q): %w", f.path, f.env, raw, err))
+		}
+	}
+
+	return errs
+}
+
+// loadFile reads a YAML (or JSON, which is valid YAML) file. Unknown keys are rejected so that
+// typos do not silently fall back to defaults.
+func loadFile(cfg *Config, path string) []error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("config file: %w", err)}
+	}
+
+	var tree map[string]any
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return []error{fmt.Errorf("config file %s: %w", path, err)}
+	}
+
+	values := make(map[string]any)
+	flatten(tree, "", values)
+
+	var errs []error
+
+	for _, f := range fields(cfg) {
+		v, ok := values[f.path]
+		if !ok {
+			continue
+		}
+
+		delete(values, f.path)
+
+		if err := set(f.value, fmt.Sprint(v)); err != nil {
+			errs = append(errs, fmt.Errorf("%s (in %s): %w", f.path, path, err))
+		}
+	}
+
+	for key := range values {
+		errs = append(errs, fmt.Errorf("%s (in %s): unknown setting", key, path))
+	}
+
+	return errs
+}
+
+func flatten(tree map[string]any, prefix string, out map[string]any) {
+	for k, v := range tree {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+
+		if sub, ok := v.(map[string]any); ok {
+			flatten(sub, key, out)
+			continue
+		}
+
+		out[key] = v
+	}
+}
+
+func set(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	if v.Type() == durationType {
+		d, err := parseDuration(raw)
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		i, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+
+		v.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+
+		v.SetBool(b)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("not a number")
+		}
+
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+
+	return nil
+}
+
+// parseDuration accepts Go durations ("250ms", "2s") and, for compatibility with the original
+// environment variables, bare integers meaning milliseconds.
+func parseDuration(raw string) (time.Duration, error) {
+	if ms, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("not a duration (use e.g. 500ms or a number of milliseconds)")
+	}
+
+	return d, nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/retry"
+	"reflect"
+	"time"
+)
+
+// reloadable lists the settings that can be changed at runtime through a reload.
+var reloadable = map[string]bool{
+	"retry.interval":                true,
+	"retry.base":                    true,
+	"retry.multiplier":              true,
+	"retry.maxBackoffDelay":         true,
+	"retry.maxAttempts":             true,
+	"retry.jitter":                  true,
+	"retry.policies":                true,
+	"health.maxLatency":             true,
+	"processors.readTimeout":        true,
+	"processors.writeTimeout":       true,
+	"routing.failingGracePeriod":    true,
+	"routing.fallbackLatencyFactor": true,
+}
+
+// Tunables is the subset of Config that can be changed without a restart.
+type Tunables struct {
+	RetryInterval         time.Duration
+	RetryBase             time.Duration
+	RetryMultiplier       float64
+	MaxBackoffDelay       time.Duration
+	RetryMaxAttempts      int
+	RetryJitter           string
+	RetryPolicies         string
+	MaxLatency            time.Duration
+	ReadTimeout           time.Duration
+	WriteTimeout          time.Duration
+	FailingGracePeriod    time.Duration
+	FallbackLatencyFactor float64
+}
+
+func (c Config) Tunables() Tunables {
+	return Tunables{
+		RetryInterval:         c.Retry.Interval,
+		RetryBase:             c.Retry.Base,
+		RetryMultiplier:       c.Retry.Multiplier,
+		MaxBackoffDelay:       c.Retry.MaxBackoffDelay,
+		RetryMaxAttempts:      c.Retry.MaxAttempts,
+		RetryJitter:           c.Retry.Jitter,
+		RetryPolicies:         c.Retry.Policies,
+		MaxLatency:            c.Health.MaxLatency,
+		ReadTimeout:           c.Processors.ReadTimeout,
+		WriteTimeout:          c.Processors.WriteTimeout,
+		FailingGracePeriod:    c.Routing.FailingGracePeriod,
+		FallbackLatencyFactor: c.Routing.FallbackLatencyFactor,
+	}
+}
+
+// Retry builds the retry policies from the retry settings.
+func (t Tunables) Retry() (retry.Policies, error) {
+	return retry.Parse(retry.Policy{
+		Base:        t.RetryBase,
+		Multiplier:  t.RetryMultiplier,
+		Max:         t.MaxBackoffDelay,
+		MaxAttempts: t.RetryMaxAttempts,
+		Jitter:      t.RetryJitter,
+	}, t.RetryPolicies)
+}
+
+// RestartRequired returns the settings that differ between c and next but cannot be reloaded.
+func (c Config) RestartRequired(next Config) []string {
+	current := fields(&c)
+	updated := fields(&next)
+
+	var changed []string
+	for i, f := range current {
+		if reloadable[f.path] {
+			continue
+		}
+
+		if !reflect.DeepEqual(f.value.Interface(), updated[i].value.Interface()) {
+			changed = append(changed, f.path)
+		}
+	}
+
+	return changed
+}
+
+// WithTunables returns a copy of c with the reloadable settings taken from t.
+func (c Config) WithTunables(t Tunables) Config {
+	c.Retry.Interval = t.RetryInterval
+	c.Retry.Base = t.RetryBase
+	c.Retry.Multiplier = t.RetryMultiplier
+	c.Retry.MaxBackoffDelay = t.MaxBackoffDelay
+	c.Retry.MaxAttempts = t.RetryMaxAttempts
+	c.Retry.Jitter = t.RetryJitter
+	c.Retry.Policies = t.RetryPolicies
+	c.Health.MaxLatency = t.MaxLatency
+	c.Processors.ReadTimeout = t.ReadTimeout
+	c.Processors.WriteTimeout = t.WriteTimeout
+	c.Routing.FailingGracePeriod = t.FailingGracePeriod
+	c.Routing.FallbackLatencyFactor = t.FallbackLatencyFactor
+
+	return c
+}
@@ -1,43 +0,0 @@
-package env
-
-import (
-	"os"
-	"strconv"
-)
-
-func GetEnvAsString(key string, defaultValue string) string {
-	value, ok := os.LookupEnv(key)
-	if !ok {
-		return defaultValue
-	}
-
-	return value
-}
-
-func GetEnvAsInt(key string, defaultValue int) int {
-	value, ok := os.LookupEnv(key)
-	if !ok {
-		return defaultValue
-	}
-
-	intValue, err := strconv.Atoi(value)
-	if err != nil {
-		return defaultValue
-	}
-
-	return intValue
-}
-
-func GetEnvAsBool(key string, defaultValue bool) bool {
-	value, ok := os.LookupEnv(key)
-	if !ok {
-		return defaultValue
-	}
-
-	boolValue, err := strconv.ParseBool(value)
-	if err != nil {
-		return defaultValue
-	}
-
-	return boolValue
-}
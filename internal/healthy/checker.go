@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"github.com/buger/jsonparser"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
 	"github.com/redis/go-redis/v9"
 	"github.com/valyala/fasthttp"
 	"log/slog"
 	"math"
 	"net/http"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -21,6 +24,13 @@ type ServiceHealth struct {
 	MinResponseTime int64
 }
 
+// Routing holds the thresholds used to choose a processor. It can be swapped at runtime.
+type Routing struct {
+	MaxLatency            time.Duration
+	FailingGracePeriod    time.Duration
+	FallbackLatencyFactor float64
+}
+
 type Checker struct {
 	httpClient              *fasthttp.Client
 	dpr                     string
@@ -28,36 +38,69 @@ type Checker struct {
 	client                  *redis.Client
 	currentProcessor        atomic.Value
 	isPublisher             bool
-	maxLatency              int64
+	routing                 atomic.Pointer[Routing]
+	override                atomic.Pointer[Override]
 	isDefaultFailing        bool
 	defaultFailingStartTime time.Time
 }
 
-func New(client *redis.Client, httpClient *fasthttp.Client, dpr, fpr string, maxLatency int64, isPublisher bool) *Checker {
-	return &Checker{
+// New creates the checker. Without a Redis client it runs alone: it checks the processors itself,
+// whatever isPublisher says, and overrides only apply to this instance.
+func New(client *redis.Client, httpClient *fasthttp.Client, dpr, fpr string, routing Routing, isPublisher bool) *Checker {
+	c := &Checker{
 		client:      client,
 		dpr:         dpr + "/payments/service-health",
 		fpr:         fpr + "/payments/service-health",
-		maxLatency:  maxLatency,
 		isPublisher: isPublisher,
 		httpClient:  httpClient,
 	}
+
+	c.routing.Store(&routing)
+
+	return c
+}
+
+// OnConfigChanged applies new routing thresholds; they take effect on the next health check.
+func (c *Checker) OnConfigChanged(msg messages.RoutingConfigChanged) {
+	c.routing.Store(&Routing{
+		MaxLatency:            msg.MaxLatency,
+		FailingGracePeriod:    msg.FailingGracePeriod,
+		FallbackLatencyFactor: msg.FallbackLatencyFactor,
+	})
 }
 
 func (c *Checker) Start() {
+	if c.client == nil {
+		go c.startCheckingServiceHealth()
+		return
+	}
+
+	c.loadOverride()
+
 	if c.isPublisher {
 		go c.startCheckingServiceHealth()
-	} else {
-		go c.startListeningServiceHealth()
 	}
+
+	// Every pod listens, the publisher included, since overrides can be issued from any of them.
+	go c.startListeningServiceHealth()
 }
 
 func (c *Checker) startListeningServiceHealth() {
 	sub := c.client.Subscribe(context.Background(), statusChannel)
 
 	for msg := range sub.Channel() {
-		slog.Info("API received: " + msg.Payload)
+		if strings.HasPrefix(msg.Payload, overridePrefix) {
+			c.applyOverride(msg.Payload)
+			continue
+		}
+
+		if c.isPublisher {
+			continue
+		}
+
+		slog.Info("Processor update received", slog.String("processor", msg.Payload))
 		c.currentProcessor.Store(msg.Payload)
+		metrics.SetRoutedProcessor(msg.Payload)
 	}
 }
 
@@ -90,7 +133,7 @@ func (c *Checker) checkServiceHealth() {
 	go func() {
 		hcapi, err := c.doFallbackProcessorHC()
 		if err != nil {
-			slog.Error("Fallback processor health check failed", slog.String("error", err.Error()))
+			slog.Error("Fallback processor health check failed", slog.String("processor", "fallback"), slog.String("error", err.Error()))
 			respChan <- ServiceHealth{Processor: "fallback", Failing: true}
 			return
 		}
@@ -106,6 +149,7 @@ func (c *Checker) checkServiceHealth() {
 	processor := c.chooseProcessor(hcs)
 	slog.Info("Checking service health", slog.String("processor", processor))
 	c.currentProcessor.Store(processor)
+	metrics.SetRoutedProcessor(processor)
 
 	c.broadcastProcessor(processor)
 }
@@ -116,7 +160,10 @@ func (c *Checker) chooseProcessor(hcs map[string]ServiceHealth) string {
 	fbk := hcs["fallback"]
 	now := time.Now()
 
-	if def.Failing || def.MinResponseTime > c.maxLatency {
+	routing := c.routing.Load()
+	maxLatency := routing.MaxLatency.Milliseconds()
+
+	if def.Failing || def.MinResponseTime > maxLatency {
 		if !c.isDefaultFailing {
 			c.isDefaultFailing = true
 			c.defaultFailingStartTime = now
@@ -131,23 +178,23 @@ func (c *Checker) chooseProcessor(hcs map[string]ServiceHealth) string {
 
 	if c.isDefaultFailing {
 		elapsed := now.Sub(c.defaultFailingStartTime)
-		if elapsed < 20*time.Second {
+		if elapsed < routing.FailingGracePeriod {
 			return "waiting"
 		}
 	}
 
-	if !fbk.Failing && fbk.MinResponseTime < c.maxLatency {
+	if !fbk.Failing && fbk.MinResponseTime < maxLatency {
 		return "fallback"
 	}
 
 	if def.Failing && fbk.Failing {
 		return "none"
 	}
-	if def.MinResponseTime > c.maxLatency && fbk.MinResponseTime > c.maxLatency {
+	if def.MinResponseTime > maxLatency && fbk.MinResponseTime > maxLatency {
 		return "none"
 	}
 
-	if c.isDefaultFailing && !fbk.Failing && def.MinResponseTime > fbk.MinResponseTime+(fbk.MinResponseTime/2) {
+	if c.isDefaultFailing && !fbk.Failing && float64(def.MinResponseTime) > float64(fbk.MinResponseTime)*routing.FallbackLatencyFactor {
 		return "fallback"
 	}
 
@@ -164,20 +211,31 @@ func computeEffectiveCost(tax float64, latency int64, failing bool) float64 {
 
 func (c *Checker) SetValue(s string) {
 	c.currentProcessor.Store(s)
+	metrics.SetRoutedProcessor(s)
 }
 
-func (c *Checker) GetPaymentProcessor() (string, error) {
+// ChosenProcessor returns the processor picked by the health checks, before any override.
+func (c *Checker) ChosenProcessor() string {
 	v := c.currentProcessor.Load()
-	if v == nil || v.(string) == "none" || v.(string) == "waiting" {
+	if v == nil {
+		return ""
+	}
+
+	return v.(string)
+}
+
+func (c *Checker) GetPaymentProcessor() (string, error) {
+	p := c.effectiveProcessor(c.ChosenProcessor())
+	if p == "" || p == "none" || p == "waiting" {
 		return "", errors.New("no payment processor available")
 	}
 
-	return v.(string), nil
+	return p, nil
 }
 
 func (c *Checker) HasHealthyProcessors() bool {
-	v := c.currentProcessor.Load()
-	if v == nil || v.(string) == "none" {
+	p := c.effectiveProcessor(c.ChosenProcessor())
+	if p == "" || p == "none" {
 		return false
 	}
 
@@ -216,7 +274,7 @@ func (c *Checker) handleHCResponse(err error, resp *fasthttp.Response, processor
 	}
 
 	if resp.StatusCode() != http.StatusOK {
-		slog.Error("failed to do hc", slog.String("error", string(resp.Body())), slog.Int("status", resp.StatusCode()))
+		slog.Error("failed to do hc", slog.String("processor", processor), slog.String("error", string(resp.Body())), slog.Int("status", resp.StatusCode()))
 		return ServiceHealth{}, errors.New("failed to check health of processor: " + processor)
 	}
 
@@ -233,6 +291,10 @@ func (c *Checker) handleHCResponse(err error, resp *fasthttp.Response, processor
 }
 
 func (c *Checker) broadcastProcessor(processor string) {
+	if c.client == nil {
+		return
+	}
+
 	r := c.client.Publish(context.Background(), statusChannel, processor)
 	if r.Err() != nil {
 		slog.Error("Error broadcasting status", slog.String("error", r.Err().Error()))
@@ -0,0 +1,146 @@
+package healthy
+
+import (
+	"context"
+	"errors"
+	goJson "github.com/goccy/go-json"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	ModeAuto  = "auto"
+	ModeForce = "force"
+	ModeDrain = "drain"
+	ModePause = "pause"
+
+	// overridePrefix marks override payloads on the status channel, which otherwise carries the
+	// bare name of the processor chosen by the publisher.
+	overridePrefix = "override:"
+)
+
+var keyOverride = "status:override"
+
+// Override is a manual routing decision that takes precedence over the health checks until it expires.
+type Override struct {
+	Mode      string    `json:"mode"`
+	Processor string    `json:"processor,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (o *Override) active(now time.Time) bool {
+	return o != nil && o.Mode != ModeAuto && now.Before(o.ExpiresAt)
+}
+
+func NewOverride(mode, processor string, ttl time.Duration) (Override, error) {
+	switch mode {
+	case ModeAuto, ModePause:
+		processor = ""
+	case ModeForce, ModeDrain:
+		if processor != "default" && processor != "fallback" {
+			return Override{}, errors.New("processor must be default or fallback")
+		}
+	default:
+		return Override{}, errors.New("unknown override mode: " + mode)
+	}
+
+	if mode != ModeAuto && ttl <= 0 {
+		return Override{}, errors.New("ttl must be positive")
+	}
+
+	return Override{Mode: mode, Processor: processor, ExpiresAt: time.Now().Add(ttl)}, nil
+}
+
+// SetOverride applies the override locally, stores it in Redis so pods started later pick it up,
+// and broadcasts it on the status channel so every running pod applies it.
+func (c *Checker) SetOverride(o Override) error {
+	payload, err := goJson.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	if c.client == nil {
+		c.override.Store(&o)
+		return nil
+	}
+
+	ctx := context.Background()
+
+	if o.Mode == ModeAuto {
+		err = c.client.Del(ctx, keyOverride).Err()
+	} else {
+		err = c.client.Set(ctx, keyOverride, payload, time.Until(o.ExpiresAt)).Err()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.override.Store(&o)
+
+	return c.client.Publish(ctx, statusChannel, overridePrefix+string(payload)).Err()
+}
+
+// Override returns the override in effect, if any.
+func (c *Checker) Override() (Override, bool) {
+	o := c.override.Load()
+	if !o.active(time.Now()) {
+		return Override{}, false
+	}
+
+	return *o, true
+}
+
+func (c *Checker) loadOverride() {
+	payload, err := c.client.Get(context.Background(), keyOverride).Result()
+	if errors.Is(err, redis.Nil) {
+		return
+	}
+
+	if err != nil {
+		slog.Error("Error loading processor override", slog.String("error", err.Error()))
+		return
+	}
+
+	c.applyOverride(payload)
+}
+
+func (c *Checker) applyOverride(payload string) {
+	var o Override
+	if err := goJson.Unmarshal([]byte(strings.TrimPrefix(payload, overridePrefix)), &o); err != nil {
+		slog.Error("Invalid processor override", slog.String("payload", payload), slog.String("error", err.Error()))
+		return
+	}
+
+	slog.Warn("Processor override applied", slog.String("mode", o.Mode), slog.String("processor", o.Processor), slog.Time("expiresAt", o.ExpiresAt))
+	c.override.Store(&o)
+}
+
+// effectiveProcessor applies the override in effect to the processor chosen by the health checks.
+func (c *Checker) effectiveProcessor(chosen string) string {
+	o := c.override.Load()
+	if !o.active(time.Now()) {
+		return chosen
+	}
+
+	switch o.Mode {
+	case ModePause:
+		return "none"
+	case ModeForce:
+		return o.Processor
+	case ModeDrain:
+		if chosen != o.Processor {
+			return chosen
+		}
+
+		if o.Processor == "default" {
+			return "fallback"
+		}
+
+		return "default"
+	}
+
+	return chosen
+}
@@ -0,0 +1,111 @@
+package hedge
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Config controls when a slow processor call is hedged.
+type Config struct {
+	// Percentile of the recent call latencies after which a call counts as slow, between 0 and 1.
+	Percentile float64
+	// MinDelay is the shortest a call may run before being hedged, whatever the percentile says.
+	MinDelay time.Duration
+	// Window is the number of recent latencies kept per processor.
+	Window int
+	// LookupTimeout bounds the lookup made before sending the payment a second time.
+	LookupTimeout time.Duration
+}
+
+// Hedger tracks the latency of each processor and tells how long a call may run before it is
+// hedged. A nil Hedger never hedges.
+type Hedger struct {
+	cfg      Config
+	trackers map[string]*tracker
+}
+
+func New(cfg Config, processors ...string) *Hedger {
+	h := &Hedger{cfg: cfg, trackers: make(map[string]*tracker, len(processors))}
+	for _, p := range processors {
+		h.trackers[p] = &tracker{samples: make([]time.Duration, cfg.Window)}
+	}
+
+	return h
+}
+
+// Observe records the latency of a call to processor that got a response.
+func (h *Hedger) Observe(processor string, d time.Duration) {
+	if h == nil {
+		return
+	}
+
+	if t, ok := h.trackers[processor]; ok {
+		t.observe(d, h.cfg.Percentile)
+	}
+}
+
+// Delay returns how long a call to processor may run before it is hedged, or 0 if it should not be,
+// either because hedging is disabled or because there are not enough samples yet.
+func (h *Hedger) Delay(processor string) time.Duration {
+	if h == nil {
+		return 0
+	}
+
+	t, ok := h.trackers[processor]
+	if !ok {
+		return 0
+	}
+
+	d := t.delay()
+	if d == 0 {
+		return 0
+	}
+
+	return max(d, h.cfg.MinDelay)
+}
+
+func (h *Hedger) LookupTimeout() time.Duration {
+	return h.cfg.LookupTimeout
+}
+
+// tracker keeps a ring of recent latencies. The percentile is recomputed every few samples rather
+// than on each call, since it only needs to follow the trend.
+type tracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	count   int
+	stale   int
+	current time.Duration
+}
+
+func (t *tracker) observe(d time.Duration, percentile float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	window := len(t.samples)
+
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % window
+	t.count = min(t.count+1, window)
+	t.stale++
+
+	// Wait for a quarter of the window before trusting the percentile.
+	if t.count < max(window/4, 1) || t.stale < max(window/8, 1) {
+		return
+	}
+
+	sorted := slices.Clone(t.samples[:t.count])
+	slices.Sort(sorted)
+
+	t.current = sorted[min(int(percentile*float64(t.count)), t.count-1)]
+	t.stale = 0
+}
+
+func (t *tracker) delay() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.current
+}
@@ -0,0 +1,97 @@
+package limiter
+
+import (
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"sync"
+	"time"
+)
+
+// Config holds the settings of an AIMD limiter.
+type Config struct {
+	Initial int
+	Min     int
+	Max     int
+	// BackoffRatio multiplies the limit when a call is dropped or slow.
+	BackoffRatio float64
+	// LatencyThreshold is the latency above which a successful call still counts as a sign of
+	// overload.
+	LatencyThreshold time.Duration
+}
+
+// AIMD limits the number of calls in flight to a processor. The limit grows by one for every
+// limit calls that complete quickly (additive increase) and is cut by BackoffRatio whenever a call
+// fails in a way that suggests overload or runs past LatencyThreshold (multiplicative decrease),
+// so it follows what the processor can take instead of piling up timeouts.
+type AIMD struct {
+	mu       sync.Mutex
+	name     string
+	cfg      Config
+	limit    float64
+	inflight int
+}
+
+func NewAIMD(name string, cfg Config) *AIMD {
+	l := &AIMD{name: name, cfg: cfg, limit: float64(cfg.Initial)}
+	l.observe()
+
+	return l
+}
+
+// Acquire takes a slot, reporting false when the limit is reached.
+func (l *AIMD) Acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inflight >= int(l.limit) {
+		return false
+	}
+
+	l.inflight++
+	l.observe()
+
+	return true
+}
+
+// Release gives back a slot taken by Acquire, adjusting the limit with the outcome of the call.
+func (l *AIMD) Release(latency time.Duration, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+
+	switch {
+	case dropped || latency > l.cfg.LatencyThreshold:
+		l.limit = max(float64(l.cfg.Min), l.limit*l.cfg.BackoffRatio)
+	case float64(l.inflight+1)*2 >= l.limit:
+		// Only grow while the limit is actually being used, otherwise a quiet period would let it
+		// climb far above what was ever tested.
+		l.limit = min(float64(l.cfg.Max), l.limit+1/l.limit)
+	}
+
+	l.observe()
+}
+
+// Limit returns the current limit.
+func (l *AIMD) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit)
+}
+
+func (l *AIMD) observe() {
+	metrics.ConcurrencyLimit.WithLabelValues(l.name).Set(float64(int(l.limit)))
+	metrics.ConcurrencyInflight.WithLabelValues(l.name).Set(float64(l.inflight))
+}
+
+// Set holds a limiter per processor.
+type Set map[string]*AIMD
+
+func NewSet(cfg Config, processors ...string) Set {
+	s := make(Set, len(processors))
+	for _, p := range processors {
+		s[p] = NewAIMD(p, cfg)
+	}
+
+	return s
+}
@@ -0,0 +1,106 @@
+package limiter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	Initial:          10,
+	Min:              2,
+	Max:              20,
+	BackoffRatio:     0.5,
+	LatencyThreshold: 100 * time.Millisecond,
+}
+
+func TestAIMDRelease(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  int
+		inflight int
+		latency  time.Duration
+		dropped  bool
+		want     float64
+	}{
+		{"dropped call cuts the limit", 10, 1, 10 * time.Millisecond, true, 5},
+		{"slow call cuts the limit", 10, 1, 200 * time.Millisecond, false, 5},
+		{"cut stops at min", 3, 1, 10 * time.Millisecond, true, 2},
+		{"fast call grows a used limit", 10, 6, 10 * time.Millisecond, false, 10.1},
+		{"fast call leaves an unused limit", 10, 1, 10 * time.Millisecond, false, 10},
+		{"growth stops at max", 20, 20, 10 * time.Millisecond, false, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig
+			cfg.Initial = tt.initial
+			l := NewAIMD("test", cfg)
+
+			for i := 0; i < tt.inflight; i++ {
+				if !l.Acquire() {
+					t.Fatalf("acquire %d refused", i+1)
+				}
+			}
+
+			l.Release(tt.latency, tt.dropped)
+
+			if math.Abs(l.limit-tt.want) > 1e-9 {
+				t.Errorf("got limit %v, want %v", l.limit, tt.want)
+			}
+
+			if l.inflight != tt.inflight-1 {
+				t.Errorf("got %d in flight, want %d", l.inflight, tt.inflight-1)
+			}
+		})
+	}
+}
+
+func TestAIMDAcquire(t *testing.T) {
+	cfg := testConfig
+	cfg.Initial = 3
+	l := NewAIMD("test", cfg)
+
+	for i := 0; i < 3; i++ {
+		if !l.Acquire() {
+			t.Fatalf("acquire %d refused below the limit", i+1)
+		}
+	}
+
+	if l.Acquire() {
+		t.Fatal("acquire allowed past the limit")
+	}
+
+	// After a cut, new calls wait until enough of those in flight have ended.
+	l.Release(0, true)
+	if l.Limit() != 2 || l.Acquire() {
+		t.Fatalf("got limit %d with 2 in flight, want 2 and no room", l.Limit())
+	}
+
+	l.Release(0, false)
+	if !l.Acquire() {
+		t.Fatal("acquire refused below the limit")
+	}
+}
+
+func TestAIMDRecovers(t *testing.T) {
+	l := NewAIMD("test", testConfig)
+
+	l.Acquire()
+	l.Release(0, true)
+	if l.Limit() != 5 {
+		t.Fatalf("got limit %d after a drop, want 5", l.Limit())
+	}
+
+	// Kept busy at its limit, it grows back by about one per limit fast calls.
+	for l.Limit() < testConfig.Initial {
+		for l.Acquire() {
+		}
+
+		l.Release(time.Millisecond, false)
+	}
+
+	if l.Limit() != testConfig.Initial {
+		t.Errorf("got limit %d, want %d", l.Limit(), testConfig.Initial)
+	}
+}
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var level = new(slog.LevelVar)
+
+// Setup installs the default slog logger writing to w. The level can be changed later with SetLevel.
+func Setup(w io.Writer, levelName, format string) error {
+	l, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+
+	level.Set(l)
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return errors.New("unknown log format: " + format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
+
+func ParseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return 0, errors.New("unknown log level: " + name)
+	}
+
+	return l, nil
+}
+
+func SetLevel(name string) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+
+	level.Set(l)
+
+	return nil
+}
+
+func Level() slog.Level {
+	return level.Level()
+}
+
+// Payment logs msg tagged with the correlationId, processor and attempt of the payment it refers to.
+// The attributes are only built when the level is enabled, so it is cheap on the hot path.
+func Payment(l slog.Level, msg, cid, processor string, attempt int, attrs ...slog.Attr) {
+	logger := slog.Default()
+	if !logger.Enabled(context.Background(), l) {
+		return
+	}
+
+	attrs = append(attrs,
+		slog.String("correlationId", cid),
+		slog.String("processor", processor),
+		slog.Int("attempt", attempt),
+	)
+
+	logger.LogAttrs(context.Background(), l, msg, attrs...)
+}
@@ -1,8 +1,10 @@
 package messages
 
 import (
-	"github.com/anthdm/hollywood/actor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/outcome"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/retry"
 	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
@@ -16,9 +18,25 @@ type PushPayment struct {
 	Payment     Payment
 	ProcessedAt time.Time
 	ProcessedBy string
+	Tries       int
+	Trace       trace.SpanContext
 }
 
-type PushToRedis struct{}
+// FlushPayments asks the writer actor to write the payments it holds without waiting for a full batch.
+type FlushPayments struct{}
+
+// DrainSpill asks the writer actor to write the payments of its spill buffer again.
+type DrainSpill struct{}
+
+// PaymentsWritten reports to the writer actor how writing a batch went. Stored tells, for each
+// payment, whether it was stored or was already there; Spilled, whether the batch came from the
+// spill buffer.
+type PaymentsWritten struct {
+	Batch   []PushPayment
+	Spilled bool
+	Stored  []bool
+	Err     error
+}
 
 type PurgePayments struct{}
 
@@ -27,6 +45,99 @@ type SummarizePayments struct {
 	To   *time.Time
 }
 
+type ListPayments struct {
+	From *time.Time
+	To   *time.Time
+}
+
+type StoredPayment struct {
+	Payment     Payment
+	ProcessedBy string
+}
+
+type ListedPayments struct {
+	Payments   []StoredPayment
+	Duplicates []string
+	Malformed  int
+}
+
+type QuarantinePayments struct {
+	CIDs []string
+}
+
+type QuarantinedPayments struct {
+	Count int
+}
+
+// MigratePayments asks the db actor to rewrite the text records of payments:all in the binary
+// format.
+type MigratePayments struct{}
+
+// MigratedPayments reports a migration: Skipped records could not be encoded, or changed while
+// being migrated, and are left as they were.
+type MigratedPayments struct {
+	Migrated  int `json:"migrated"`
+	Skipped   int `json:"skipped"`
+	Malformed int `json:"malformed"`
+}
+
+// ArchivePayments asks the db actor to move the payments requested before the day of Before into
+// per-day archives.
+type ArchivePayments struct {
+	Before time.Time
+}
+
+type ArchivedPayments struct {
+	Archived    int      `json:"archived"`
+	Days        []string `json:"days"`
+	Quarantined int      `json:"quarantined"`
+}
+
+type ListArchives struct{}
+
+// Archive describes the archived payments of a day, kept in one or more parts until compacted.
+type Archive struct {
+	Day      string `json:"day"`
+	Parts    int    `json:"parts"`
+	Payments int    `json:"payments"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type ListedArchives struct {
+	Archives []Archive `json:"archives"`
+}
+
+// CompactArchives asks the db actor to merge the parts of each archived day before the day of
+// Before into one, without duplicates.
+type CompactArchives struct {
+	Before time.Time
+}
+
+type CompactedArchives struct {
+	Days       int `json:"days"`
+	Parts      int `json:"parts"`
+	Duplicates int `json:"duplicates"`
+}
+
+// DropArchives asks the db actor to delete the archives of the days before the day of Before.
+type DropArchives struct {
+	Before time.Time
+}
+
+type DroppedArchives struct {
+	Days  int `json:"days"`
+	Parts int `json:"parts"`
+}
+
+// ExportArchives asks the db actor for the archived payments of the days before the day of Before.
+type ExportArchives struct {
+	Before time.Time
+}
+
+type ExportedArchives struct {
+	Payments []StoredPayment
+}
+
 type SummarizedProcessor struct {
 	TotalAmount   decimal.Decimal `json:"totalAmount"`
 	TotalRequests int64           `json:"totalRequests"`
@@ -34,17 +145,77 @@ type SummarizedProcessor struct {
 type SummarizedPayments struct {
 	Default  SummarizedProcessor `json:"default"`
 	Fallback SummarizedProcessor `json:"fallback"`
+	// Incomplete is set while processed payments are waiting in the spill buffer of this instance.
+	Incomplete bool `json:"incomplete,omitempty"`
 }
 
+// Dispatched records which processors a payment has been sent to, across all of its attempts.
+type Dispatched uint8
+
+const (
+	DispatchedDefault Dispatched = 1 << iota
+	DispatchedFallback
+)
+
+func dispatchedFlag(processor string) Dispatched {
+	switch processor {
+	case "default":
+		return DispatchedDefault
+	case "fallback":
+		return DispatchedFallback
+	}
+
+	return 0
+}
+
+func (d Dispatched) With(processor string) Dispatched {
+	return d | dispatchedFlag(processor)
+}
+
+func (d Dispatched) Has(processor string) bool {
+	f := dispatchedFlag(processor)
+	return f != 0 && d&f == f
+}
+
+// ProcessPayment asks a processor actor to charge a payment. Backoff is the delay waited before
+// this attempt, if it is a retry.
 type ProcessPayment struct {
-	Payment Payment
-	Tries   int
+	Payment    Payment
+	Tries      int
+	Dispatched Dispatched
+	Backoff    time.Duration
+	Trace      trace.SpanContext
+}
+
+// ProcessorCallCompleted delivers the result of an asynchronous processor call to the actor that
+// started it. It carries the whole call, so an actor restarted while the call was in flight can
+// still complete it.
+type ProcessorCallCompleted struct {
+	Request   ProcessPayment
+	Processor string
+	Span      trace.Span
+	Result    outcome.Result
+	Hedged    bool
 }
 
+// Drain asks a pool actor that was removed from its pool to finish the work it holds and stop.
+type Drain struct{}
+
+// ResumeDispatch wakes a processor actor up to dispatch the payments it is holding.
+type ResumeDispatch struct{}
+
+// ScheduleRetry hands a payment to the retry actor. Processor and Outcome identify the failure the
+// retry policy is chosen for, Backoff is the delay waited before the failed attempt and RetryAfter
+// the minimum delay the processor asked for, if any.
 type ScheduleRetry struct {
-	Sender  *actor.PID
-	Payment Payment
-	Tries   int
+	Payment    Payment
+	Tries      int
+	Dispatched Dispatched
+	Processor  string
+	Outcome    outcome.Outcome
+	Backoff    time.Duration
+	RetryAfter time.Duration
+	Trace      trace.SpanContext
 }
 
 type Retry struct {
@@ -53,7 +224,41 @@ type PaymentProcessorChanged struct {
 	Processor string
 }
 
+// CheckIntegrity asks the integrity actors to find out whether a payment whose call timed out was
+// processed. Lookups and NotFound carry the state of the resolution between rounds.
 type CheckIntegrity struct {
+	Payment    Payment
+	Processor  string
+	Dispatched Dispatched
+	Tries      int
+	Lookups    int
+	NotFound   int
+	Trace      trace.SpanContext
+}
+
+// LookupIntegrity runs the next lookup round of a CheckIntegrity once its backoff has elapsed.
+type LookupIntegrity struct {
+	Check CheckIntegrity
+}
+
+type DeadLetterPayment struct {
 	Payment   Payment
 	Processor string
+	Reason    string
+}
+
+type RetryConfigChanged struct {
+	Interval time.Duration
+	Policies retry.Policies
+}
+
+type ProcessorConfigChanged struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+type RoutingConfigChanged struct {
+	MaxLatency            time.Duration
+	FailingGracePeriod    time.Duration
+	FallbackLatencyFactor float64
 }
@@ -0,0 +1,268 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"time"
+)
+
+const namespace = "rinha"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	factory = promauto.With(Registry)
+
+	latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+	PaymentsAccepted = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payments_accepted_total",
+		Help:      "Payments accepted at the HTTP edge.",
+	})
+
+	ProcessorCallDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "processor_call_duration_seconds",
+		Help:      "Latency of payment calls to the processors.",
+		Buckets:   latencyBuckets,
+	}, []string{"processor"})
+
+	ProcessorCalls = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "processor_calls_total",
+		Help:      "Payment calls to the processors, by processor and status.",
+	}, []string{"processor", "status"})
+
+	ConcurrencyLimit = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "processor_concurrency_limit",
+		Help:      "Adaptive limit of calls in flight, by processor.",
+	}, []string{"processor"})
+
+	ConcurrencyInflight = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "processor_calls_inflight",
+		Help:      "Calls in flight counted by the adaptive limiter, by processor.",
+	}, []string{"processor"})
+
+	HedgedCalls = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hedged_calls_total",
+		Help:      "Slow processor calls that were hedged, by processor and result (found_by_lookup, lookup_failed, hedged, primary_won, hedge_won).",
+	}, []string{"processor", "result"})
+
+	RetriesScheduled = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_scheduled_total",
+		Help:      "Payments pushed onto the retry heap.",
+	})
+
+	RetriesFired = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_fired_total",
+		Help:      "Payments popped from the retry heap and dispatched again.",
+	})
+
+	RetriesDeferred = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_deferred_total",
+		Help:      "Retry ticks that left due payments on the heap, by reason (paced, budget).",
+	}, []string{"reason"})
+
+	RetryBudgetAvailable = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "retry_budget_available",
+		Help:      "Retries the retry budget would currently allow.",
+	})
+
+	RetryHeapSize = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "retry_heap_size",
+		Help:      "Payments currently waiting on the retry heap.",
+	})
+
+	IntegrityChecks = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "integrity_checks_total",
+		Help:      "Processor lookups made to resolve timed out payments, by processor and result.",
+	}, []string{"processor", "result"})
+
+	IntegrityOutcomes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "integrity_outcomes_total",
+		Help:      "Timed out payments resolved by the integrity actors, by outcome (processed, redispatched, dead_letter).",
+	}, []string{"outcome"})
+
+	MailboxDepth = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_mailbox_depth",
+		Help:      "Messages queued on the actors of a pool.",
+	}, []string{"pool"})
+
+	PoolMemberDepth = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_member_mailbox_depth",
+		Help:      "Messages queued on each actor of a pool.",
+	}, []string{"pool", "member"})
+
+	PoolSize = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_size",
+		Help:      "Actors in a pool.",
+	}, []string{"pool"})
+
+	PoolRespawns = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pool_respawns_total",
+		Help:      "Pool actors that died and were spawned again, by pool.",
+	}, []string{"pool"})
+
+	PoolMeanLoad = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_mean_load",
+		Help:      "Mean payments queued on or held by each actor of a pool, as seen by the autoscaler.",
+	}, []string{"pool"})
+
+	PoolScaleDecisions = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pool_scale_decisions_total",
+		Help:      "Autoscaler decisions, by pool and decision (up, down, hold).",
+	}, []string{"pool", "decision"})
+
+	ActorCrashes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "actor_crashes_total",
+		Help:      "Panics recovered from actors, by actor kind.",
+	}, []string{"actor"})
+
+	ActorEscalations = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "actor_escalations_total",
+		Help:      "Actors that crashed more often than their supervision allows, by actor kind.",
+	}, []string{"actor"})
+
+	CrashedMessages = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "actor_crashed_messages_total",
+		Help:      "Messages that crashed an actor, by actor kind and action (redelivered, dropped).",
+	}, []string{"actor", "action"})
+
+	WriterBatches = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "writer_batches_total",
+		Help:      "Payment batches written to storage, by result (written, failed).",
+	}, []string{"result"})
+
+	WriterBatchSize = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "writer_batch_size",
+		Help:      "Payments per batch written to storage.",
+		Buckets:   []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	})
+
+	WriterBatchDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "writer_batch_duration_seconds",
+		Help:      "Latency of writing a batch of payments to storage.",
+		Buckets:   latencyBuckets,
+	})
+
+	WrittenPayments = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "writer_payments_total",
+		Help:      "Payments acknowledged by storage, by result (stored, duplicate).",
+	}, []string{"result"})
+
+	SpilledPayments = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spilled_payments",
+		Help:      "Processed payments waiting in the spill buffer to be stored, by location (memory, disk).",
+	}, []string{"location"})
+
+	RedisCommandDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Latency of Redis commands, by command.",
+		Buckets:   latencyBuckets,
+	}, []string{"command"})
+
+	RoutedProcessor = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "routed_processor",
+		Help:      "Processor currently chosen for routing (1 for the active one).",
+	}, []string{"processor"})
+
+	ReconcileRequestsDiff = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_requests_diff",
+		Help:      "Requests charged by a processor minus requests recorded, on the last reconciliation.",
+	}, []string{"processor"})
+
+	ReconcileAmountDiff = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_amount_diff",
+		Help:      "Amount charged by a processor minus amount recorded, on the last reconciliation.",
+	}, []string{"processor"})
+
+	Verifications = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "verifications_total",
+		Help:      "Stored payments checked against the processor lookup endpoint, by verdict.",
+	}, []string{"verdict"})
+
+	routedProcessors = []string{"default", "fallback", "waiting", "none"}
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func Handler() fasthttp.RequestHandler {
+	return fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+}
+
+func SetRoutedProcessor(processor string) {
+	for _, p := range routedProcessors {
+		if p == processor {
+			RoutedProcessor.WithLabelValues(p).Set(1)
+			continue
+		}
+
+		RoutedProcessor.WithLabelValues(p).Set(0)
+	}
+}
+
+// RedisHook records the latency of every command sent through a redis.Client.
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		RedisCommandDuration.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		RedisCommandDuration.WithLabelValues("pipeline").Observe(time.Since(start).Seconds())
+		return err
+	}
+}
@@ -0,0 +1,203 @@
+package outcome
+
+import (
+	"errors"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Outcome classifies the result of a call to a payment processor. What we may do next depends on
+// it: only outcomes where the processor surely did not charge can be retried blindly, and the ones
+// where it may have charged must be resolved through the lookup endpoint first.
+type Outcome uint8
+
+const (
+	// Success is a 2xx: the payment was charged.
+	Success Outcome = iota
+	// Duplicate is a 422: the processor already has a payment with this correlationId.
+	Duplicate
+	// Rejected is any other 4xx: the processor refused the payment and will keep refusing it.
+	Rejected
+	// ServerError is a 5xx or a 408: the processor failed without charging.
+	ServerError
+	// RateLimited is a 429: the processor asks us to slow down, possibly with a Retry-After.
+	RateLimited
+	// ConnectionError means the connection could not be established, so nothing was sent.
+	ConnectionError
+	// TimeoutBeforeSend means we gave up before sending: dialing or waiting for a free connection
+	// took too long.
+	TimeoutBeforeSend
+	// TimeoutAfterSend means the request may have reached the processor but no response came back
+	// in time, or the connection was dropped before one did.
+	TimeoutAfterSend
+	// Unavailable means no call was made because no processor was available.
+	Unavailable
+)
+
+var names = [...]string{
+	Success:           "success",
+	Duplicate:         "duplicate",
+	Rejected:          "rejected",
+	ServerError:       "server_error",
+	RateLimited:       "rate_limited",
+	ConnectionError:   "connection_error",
+	TimeoutBeforeSend: "timeout_before_send",
+	TimeoutAfterSend:  "timeout_after_send",
+	Unavailable:       "unavailable",
+}
+
+// All lists every outcome, in declaration order.
+var All = []Outcome{Success, Duplicate, Rejected, ServerError, RateLimited, ConnectionError, TimeoutBeforeSend, TimeoutAfterSend, Unavailable}
+
+func (o Outcome) String() string {
+	if int(o) < len(names) {
+		return names[o]
+	}
+
+	return "unknown"
+}
+
+// Parse returns the outcome with the given name, as printed by String.
+func Parse(s string) (Outcome, error) {
+	for _, o := range All {
+		if o.String() == s {
+			return o, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown outcome %q", s)
+}
+
+// Processed reports whether the processor holds the payment.
+func (o Outcome) Processed() bool {
+	return o == Success || o == Duplicate
+}
+
+// Retryable reports whether the payment can be sent again right away, since the processor surely
+// did not charge it.
+func (o Outcome) Retryable() bool {
+	switch o {
+	case ServerError, RateLimited, ConnectionError, TimeoutBeforeSend, Unavailable:
+		return true
+	}
+
+	return false
+}
+
+// Ambiguous reports whether the processor may or may not have charged the payment.
+func (o Outcome) Ambiguous() bool {
+	return o == TimeoutAfterSend
+}
+
+// Result is a classified processor response.
+type Result struct {
+	Outcome    Outcome
+	Status     int
+	RetryAfter time.Duration
+	Err        error
+}
+
+// Error is returned by processor calls that did not succeed, carrying their classification.
+type Error struct {
+	Result
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Outcome.String() + ": " + e.Err.Error()
+	}
+
+	return e.Outcome.String() + ": status " + strconv.Itoa(e.Status)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Of returns the outcome carried by err, or false if err was not produced by a classified call.
+func Of(err error) (Outcome, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Outcome, true
+	}
+
+	return 0, false
+}
+
+// Classify turns the response and error of a fasthttp call into a Result. resp is only read when
+// err is nil.
+func Classify(resp *fasthttp.Response, err error) Result {
+	if err != nil {
+		return Result{Outcome: classifyErr(err), Err: err}
+	}
+
+	status := resp.StatusCode()
+	r := Result{Status: status}
+
+	switch {
+	case status >= 200 && status < 300:
+		r.Outcome = Success
+	case status == fasthttp.StatusUnprocessableEntity:
+		r.Outcome = Duplicate
+	case status == fasthttp.StatusTooManyRequests:
+		r.Outcome = RateLimited
+		r.RetryAfter = retryAfter(resp.Header.Peek(fasthttp.HeaderRetryAfter))
+	case status == fasthttp.StatusRequestTimeout || status >= 500:
+		r.Outcome = ServerError
+	default:
+		r.Outcome = Rejected
+	}
+
+	return r
+}
+
+func classifyErr(err error) Outcome {
+	if errors.Is(err, fasthttp.ErrDialTimeout) || errors.Is(err, fasthttp.ErrNoFreeConns) || errors.Is(err, fasthttp.ErrTLSHandshakeTimeout) {
+		return TimeoutBeforeSend
+	}
+
+	var dialErr *fasthttp.ErrDialWithUpstream
+	if errors.As(err, &dialErr) || errors.Is(err, syscall.ECONNREFUSED) {
+		return ConnectionError
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		if opErr.Timeout() {
+			return TimeoutBeforeSend
+		}
+
+		return ConnectionError
+	}
+
+	// Timeouts and dropped connections past the dial (fasthttp.ErrTimeout, ErrConnectionClosed,
+	// resets) may have happened after the processor read the request, so they cannot be told apart
+	// from a lost response. Anything unexpected is treated the same way, since charging a payment
+	// twice costs more than looking it up.
+	return TimeoutAfterSend
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(v []byte) time.Duration {
+	if len(v) == 0 {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(string(v)); err == nil {
+		if secs < 0 {
+			return 0
+		}
+
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := fasthttp.ParseHTTPDate(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+
+	return 0
+}
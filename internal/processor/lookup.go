@@ -0,0 +1,54 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/buger/jsonparser"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/outcome"
+	"github.com/valyala/fasthttp"
+	"time"
+)
+
+// ErrNotFound is returned by Lookup when the processor has no payment with the correlationId.
+var ErrNotFound = errors.New("payment not found on processor")
+
+// Lookup fetches a payment from a processor's GET /payments/{correlationId} endpoint. baseURL is
+// the processor root, without the /payments path. Failed lookups other than ErrNotFound return an
+// *outcome.Error.
+func Lookup(client *fasthttp.Client, baseURL, cid string, timeout time.Duration) (messages.Payment, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(baseURL + "/payments/" + cid)
+	req.Header.SetMethod(fasthttp.MethodGet)
+
+	err := client.DoTimeout(req, resp, timeout)
+	if err == nil && resp.StatusCode() == fasthttp.StatusNotFound {
+		return messages.Payment{}, ErrNotFound
+	}
+
+	if res := outcome.Classify(resp, err); res.Outcome != outcome.Success {
+		return messages.Payment{}, &outcome.Error{Result: res}
+	}
+
+	body := resp.Body()
+
+	amount, err := jsonparser.GetFloat(body, "amount")
+	if err != nil {
+		return messages.Payment{}, fmt.Errorf("payment lookup: %w", err)
+	}
+
+	requestedAt, err := jsonparser.GetString(body, "requestedAt")
+	if err != nil {
+		return messages.Payment{}, fmt.Errorf("payment lookup: %w", err)
+	}
+
+	return messages.Payment{
+		CID:         cid,
+		Amount:      amount,
+		RequestedAt: requestedAt,
+	}, nil
+}
@@ -0,0 +1,267 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"github.com/anthdm/hollywood/actor"
+	"github.com/buger/jsonparser"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"github.com/shopspring/decimal"
+	"github.com/valyala/fasthttp"
+	"log/slog"
+	"time"
+)
+
+var (
+	summaryPath = "/admin/payments-summary"
+	tokenHeader = "X-Rinha-Token"
+	processors  = []string{"default", "fallback"}
+)
+
+// Reconciler compares what we recorded in storage with what each processor reports having charged,
+// in aggregate through the admin summaries and per payment through the lookup endpoint.
+type Reconciler struct {
+	client            *fasthttp.Client
+	engine            *actor.Engine
+	dbActor           *actor.PID
+	urls              map[string]string
+	token             string
+	timeout           time.Duration
+	boundaryTolerance time.Duration
+}
+
+type ProcessorReport struct {
+	Processor        string          `json:"processor"`
+	RecordedRequests int64           `json:"recordedRequests"`
+	RecordedAmount   decimal.Decimal `json:"recordedAmount"`
+	ChargedRequests  int64           `json:"chargedRequests"`
+	ChargedAmount    decimal.Decimal `json:"chargedAmount"`
+	RequestsDiff     int64           `json:"requestsDiff"`
+	AmountDiff       decimal.Decimal `json:"amountDiff"`
+	Error            string          `json:"error,omitempty"`
+}
+
+func (p ProcessorReport) consistent() bool {
+	return p.Error == "" && p.RequestsDiff == 0 && p.AmountDiff.IsZero()
+}
+
+// Report is the outcome of a reconciliation. Diffs are charged minus recorded, so a positive value
+// means the processor charged payments we have no record of.
+type Report struct {
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Consistent bool              `json:"consistent"`
+	Processors []ProcessorReport `json:"processors"`
+	Duplicates []string          `json:"duplicates,omitempty"`
+	Suspicious []string          `json:"suspicious,omitempty"`
+}
+
+func New(
+	client *fasthttp.Client,
+	engine *actor.Engine,
+	dbActor *actor.PID,
+	defaultURL, fallbackURL, token string,
+	timeout, boundaryTolerance time.Duration,
+) *Reconciler {
+	return &Reconciler{
+		client:  client,
+		engine:  engine,
+		dbActor: dbActor,
+		urls: map[string]string{
+			"default":  defaultURL,
+			"fallback": fallbackURL,
+		},
+		token:             token,
+		timeout:           timeout,
+		boundaryTolerance: boundaryTolerance,
+	}
+}
+
+// Run reconciles the payments requested between from and to.
+func (r *Reconciler) Run(from, to time.Time) (Report, error) {
+	report := Report{From: from, To: to, Consistent: true}
+
+	recorded, err := r.summarize(from, to)
+	if err != nil {
+		return report, err
+	}
+
+	listed, err := r.list(&from, &to)
+	if err != nil {
+		return report, err
+	}
+
+	report.Duplicates = listed.Duplicates
+	if len(listed.Duplicates) > 0 {
+		report.Consistent = false
+	}
+
+	for _, processor := range processors {
+		pr := ProcessorReport{Processor: processor}
+
+		own := recorded.Default
+		if processor == "fallback" {
+			own = recorded.Fallback
+		}
+
+		pr.RecordedRequests = own.TotalRequests
+		pr.RecordedAmount = own.TotalAmount
+
+		charged, err := r.fetchSummary(processor, from, to)
+		if err != nil {
+			pr.Error = err.Error()
+		} else {
+			pr.ChargedRequests = charged.TotalRequests
+			pr.ChargedAmount = charged.TotalAmount
+			pr.RequestsDiff = pr.ChargedRequests - pr.RecordedRequests
+			pr.AmountDiff = pr.ChargedAmount.Sub(pr.RecordedAmount)
+
+			metrics.ReconcileRequestsDiff.WithLabelValues(processor).Set(float64(pr.RequestsDiff))
+			metrics.ReconcileAmountDiff.WithLabelValues(processor).Set(pr.AmountDiff.InexactFloat64())
+		}
+
+		if !pr.consistent() {
+			report.Consistent = false
+			report.Suspicious = append(report.Suspicious, r.suspicious(listed.Payments, processor, from, to)...)
+		}
+
+		report.Processors = append(report.Processors, pr)
+	}
+
+	return report, nil
+}
+
+// suspicious lists the payments of a processor requested close to the edges of the range. Our
+// requestedAt and the processor's clock differ slightly, so those are the ones most likely to be
+// counted on one side and not the other.
+func (r *Reconciler) suspicious(payments []messages.StoredPayment, processor string, from, to time.Time) []string {
+	var cids []string
+
+	for _, p := range payments {
+		if p.ProcessedBy != processor {
+			continue
+		}
+
+		requestedAt, err := time.Parse(time.RFC3339Nano, p.Payment.RequestedAt)
+		if err != nil {
+			cids = append(cids, p.Payment.CID)
+			continue
+		}
+
+		if requestedAt.Sub(from) < r.boundaryTolerance || to.Sub(requestedAt) < r.boundaryTolerance {
+			cids = append(cids, p.Payment.CID)
+		}
+	}
+
+	return cids
+}
+
+func (r *Reconciler) summarize(from, to time.Time) (messages.SummarizedPayments, error) {
+	res, err := r.engine.Request(r.dbActor, messages.SummarizePayments{From: &from, To: &to}, r.timeout).Result()
+	if err != nil {
+		return messages.SummarizedPayments{}, err
+	}
+
+	summary, ok := res.(messages.SummarizedPayments)
+	if !ok {
+		return messages.SummarizedPayments{}, errors.New("unexpected summary response from storage")
+	}
+
+	return summary, nil
+}
+
+// list fetches the stored payments; a nil bound leaves that side of the range open.
+func (r *Reconciler) list(from, to *time.Time) (messages.ListedPayments, error) {
+	res, err := r.engine.Request(r.dbActor, messages.ListPayments{From: from, To: to}, r.timeout).Result()
+	if err != nil {
+		return messages.ListedPayments{}, err
+	}
+
+	switch v := res.(type) {
+	case messages.ListedPayments:
+		return v, nil
+	case error:
+		return messages.ListedPayments{}, v
+	}
+
+	return messages.ListedPayments{}, errors.New("unexpected list response from storage")
+}
+
+func (r *Reconciler) fetchSummary(processor string, from, to time.Time) (messages.SummarizedProcessor, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(r.urls[processor] + summaryPath)
+	req.URI().QueryArgs().Set("from", from.UTC().Format(time.RFC3339Nano))
+	req.URI().QueryArgs().Set("to", to.UTC().Format(time.RFC3339Nano))
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.Header.Set(tokenHeader, r.token)
+
+	if err := r.client.DoTimeout(req, resp, r.timeout); err != nil {
+		return messages.SummarizedProcessor{}, err
+	}
+
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return messages.SummarizedProcessor{}, fmt.Errorf("processor %s summary returned status %d", processor, resp.StatusCode())
+	}
+
+	body := resp.Body()
+
+	requests, err := jsonparser.GetInt(body, "totalRequests")
+	if err != nil {
+		return messages.SummarizedProcessor{}, fmt.Errorf("processor %s summary: %w", processor, err)
+	}
+
+	amount, err := jsonparser.GetFloat(body, "totalAmount")
+	if err != nil {
+		return messages.SummarizedProcessor{}, fmt.Errorf("processor %s summary: %w", processor, err)
+	}
+
+	return messages.SummarizedProcessor{
+		TotalRequests: requests,
+		TotalAmount:   decimal.NewFromFloat(amount),
+	}, nil
+}
+
+// Start reconciles a sliding window every interval. The window ends settleDelay in the past so
+// payments still in flight are not reported as missing.
+func (r *Reconciler) Start(interval, window, settleDelay time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			to := time.Now().UTC().Add(-settleDelay)
+			from := to.Add(-window)
+
+			report, err := r.Run(from, to)
+			if err != nil {
+				slog.Error("Error reconciling payments", slog.String("error", err.Error()))
+				continue
+			}
+
+			if report.Consistent {
+				slog.Info("Payments reconciled", slog.Time("from", from), slog.Time("to", to))
+				continue
+			}
+
+			for _, pr := range report.Processors {
+				slog.Warn("Payments discrepancy",
+					slog.String("processor", pr.Processor),
+					slog.Int64("requestsDiff", pr.RequestsDiff),
+					slog.String("amountDiff", pr.AmountDiff.String()),
+					slog.String("error", pr.Error),
+					slog.Time("from", from),
+					slog.Time("to", to),
+				)
+			}
+
+			if len(report.Duplicates) > 0 || len(report.Suspicious) > 0 {
+				slog.Warn("Suspicious payments", slog.Any("duplicates", report.Duplicates), slog.Any("suspicious", report.Suspicious))
+			}
+		}
+	}()
+}
@@ -0,0 +1,277 @@
+package reconcile
+
+import (
+	"errors"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/processor"
+	"github.com/shopspring/decimal"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+const (
+	VerdictOK       = "ok"
+	VerdictMismatch = "mismatch"
+	VerdictDenied   = "denied"
+	VerdictLost     = "lost"
+	VerdictMissing  = "missing"
+	VerdictUnknown  = "unknown"
+)
+
+// Verification is the outcome of checking one payment against the processor lookup endpoint.
+type Verification struct {
+	CID       string            `json:"correlationId"`
+	Processor string            `json:"processor,omitempty"`
+	Verdict   string            `json:"verdict"`
+	Stored    *messages.Payment `json:"stored,omitempty"`
+	Charged   *messages.Payment `json:"charged,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Repaired  bool              `json:"repaired"`
+}
+
+// VerifyReport lists every verification that was not ok, with totals per verdict.
+type VerifyReport struct {
+	Checked     int            `json:"checked"`
+	Verdicts    map[string]int `json:"verdicts"`
+	Findings    []Verification `json:"findings,omitempty"`
+	Recorded    int            `json:"recorded"`
+	Quarantined int            `json:"quarantined"`
+}
+
+func (r *VerifyReport) add(v Verification) {
+	r.Checked++
+	r.Verdicts[v.Verdict]++
+	metrics.Verifications.WithLabelValues(v.Verdict).Inc()
+
+	if v.Verdict != VerdictOK {
+		r.Findings = append(r.Findings, v)
+	}
+}
+
+// VerifyCIDs checks the given correlationIds. Stored ones are looked up on the processor that we
+// recorded; the others are looked up on both, to find payments that were charged but lost by us.
+// With repair, lost payments are recorded and denied ones are quarantined.
+func (r *Reconciler) VerifyCIDs(cids []string, repair bool) (VerifyReport, error) {
+	listed, err := r.list(nil, nil)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	stored := make(map[string]messages.StoredPayment, len(listed.Payments))
+	for _, p := range listed.Payments {
+		stored[p.Payment.CID] = p
+	}
+
+	report := VerifyReport{Verdicts: map[string]int{}}
+	var denied []string
+
+	for _, cid := range cids {
+		p, ok := stored[cid]
+		if ok {
+			v := r.verifyStored(p)
+			if v.Verdict == VerdictDenied {
+				denied = append(denied, cid)
+			}
+
+			report.add(v)
+			continue
+		}
+
+		v := r.findLost(cid)
+		if v.Verdict == VerdictLost && repair {
+			r.engine.Send(r.dbActor, messages.PushPayment{
+				Payment:     *v.Charged,
+				ProcessedBy: v.Processor,
+				ProcessedAt: time.Now().UTC(),
+			})
+
+			v.Repaired = true
+			report.Recorded++
+		}
+
+		report.add(v)
+	}
+
+	if repair && len(denied) > 0 {
+		n, err := r.quarantine(denied)
+		if err != nil {
+			return report, err
+		}
+
+		report.Quarantined = n
+		r.markRepaired(&report, VerdictDenied)
+	}
+
+	return report, nil
+}
+
+// VerifyRange checks up to limit stored payments, picked at random, requested between from and to.
+func (r *Reconciler) VerifyRange(from, to time.Time, limit int, repair bool) (VerifyReport, error) {
+	listed, err := r.list(&from, &to)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	payments := listed.Payments
+	if limit > 0 && len(payments) > limit {
+		rand.Shuffle(len(payments), func(i, j int) { payments[i], payments[j] = payments[j], payments[i] })
+		payments = payments[:limit]
+	}
+
+	report := VerifyReport{Verdicts: map[string]int{}}
+	var denied []string
+
+	for _, p := range payments {
+		v := r.verifyStored(p)
+		if v.Verdict == VerdictDenied {
+			denied = append(denied, p.Payment.CID)
+		}
+
+		report.add(v)
+	}
+
+	if repair && len(denied) > 0 {
+		n, err := r.quarantine(denied)
+		if err != nil {
+			return report, err
+		}
+
+		report.Quarantined = n
+		r.markRepaired(&report, VerdictDenied)
+	}
+
+	return report, nil
+}
+
+func (r *Reconciler) verifyStored(p messages.StoredPayment) Verification {
+	stored := p.Payment
+	v := Verification{CID: stored.CID, Processor: p.ProcessedBy, Stored: &stored}
+
+	url, ok := r.urls[p.ProcessedBy]
+	if !ok {
+		v.Verdict = VerdictUnknown
+		v.Error = "unknown processor " + p.ProcessedBy
+		return v
+	}
+
+	charged, err := processor.Lookup(r.client, url, stored.CID, r.timeout)
+	if errors.Is(err, processor.ErrNotFound) {
+		v.Verdict = VerdictDenied
+		return v
+	}
+
+	if err != nil {
+		v.Verdict = VerdictUnknown
+		v.Error = err.Error()
+		return v
+	}
+
+	v.Charged = &charged
+	v.Verdict = VerdictOK
+
+	if !samePayment(stored, charged) {
+		v.Verdict = VerdictMismatch
+	}
+
+	return v
+}
+
+func (r *Reconciler) findLost(cid string) Verification {
+	v := Verification{CID: cid, Verdict: VerdictMissing}
+
+	for _, name := range processors {
+		charged, err := processor.Lookup(r.client, r.urls[name], cid, r.timeout)
+		if errors.Is(err, processor.ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			v.Verdict = VerdictUnknown
+			v.Error = err.Error()
+			continue
+		}
+
+		v.Verdict = VerdictLost
+		v.Processor = name
+		v.Charged = &charged
+		v.Error = ""
+
+		return v
+	}
+
+	return v
+}
+
+func (r *Reconciler) quarantine(cids []string) (int, error) {
+	res, err := r.engine.Request(r.dbActor, messages.QuarantinePayments{CIDs: cids}, r.timeout).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := res.(type) {
+	case messages.QuarantinedPayments:
+		return v.Count, nil
+	case error:
+		return 0, v
+	}
+
+	return 0, errors.New("unexpected quarantine response from storage")
+}
+
+func (r *Reconciler) markRepaired(report *VerifyReport, verdict string) {
+	for i := range report.Findings {
+		if report.Findings[i].Verdict == verdict {
+			report.Findings[i].Repaired = true
+		}
+	}
+}
+
+func samePayment(stored, charged messages.Payment) bool {
+	if !decimal.NewFromFloat(stored.Amount).Equal(decimal.NewFromFloat(charged.Amount)) {
+		return false
+	}
+
+	s, err := time.Parse(time.RFC3339Nano, stored.RequestedAt)
+	if err != nil {
+		return false
+	}
+
+	c, err := time.Parse(time.RFC3339Nano, charged.RequestedAt)
+	if err != nil {
+		return false
+	}
+
+	return s.Equal(c)
+}
+
+// StartSampler verifies sampleSize random payments from the last window every interval, logging
+// anything that does not match.
+func (r *Reconciler) StartSampler(interval, window time.Duration, sampleSize int, repair bool) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			to := time.Now().UTC()
+			from := to.Add(-window)
+
+			report, err := r.VerifyRange(from, to, sampleSize, repair)
+			if err != nil {
+				slog.Error("Error verifying payments", slog.String("error", err.Error()))
+				continue
+			}
+
+			for _, f := range report.Findings {
+				slog.Warn("Payment verification failed",
+					slog.String("correlationId", f.CID),
+					slog.String("processor", f.Processor),
+					slog.String("verdict", f.Verdict),
+					slog.String("error", f.Error),
+					slog.Bool("repaired", f.Repaired),
+				)
+			}
+		}
+	}()
+}
@@ -0,0 +1,191 @@
+package record
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version1 is the first byte of a binary record. Text records start with a correlationId, so they
+// never start with it.
+const Version1 byte = 1
+
+// Size is the length of a version 1 record: version, UUID, amount in cents, requestedAt in unix
+// nanoseconds and processor.
+const Size = 1 + 16 + 8 + 8 + 1
+
+var (
+	ErrMalformed = errors.New("malformed record")
+	// ErrNotEncodable is returned for payments the binary format cannot hold, such as a
+	// correlationId that is not a lowercase UUID; they are stored as text instead.
+	ErrNotEncodable = errors.New("payment cannot be encoded as a binary record")
+)
+
+var processorIDs = map[string]byte{"default": 1, "fallback": 2}
+
+var processorNames = [...]string{1: "default", 2: "fallback"}
+
+// minTime and maxTime bound the requestedAt a binary record can hold in int64 unix nanoseconds.
+var (
+	minTime = time.Unix(0, math.MinInt64)
+	maxTime = time.Unix(0, math.MaxInt64)
+)
+
+// Record is a stored payment.
+type Record struct {
+	CID         string
+	Cents       int64
+	RequestedAt time.Time
+	Processor   string
+}
+
+// New builds the record of a payment as it is received and sent to the processors.
+func New(cid string, amount float64, requestedAt, processor string) (Record, error) {
+	t, err := time.Parse(time.RFC3339Nano, requestedAt)
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: requestedAt: %v", ErrMalformed, err)
+	}
+
+	if math.IsNaN(amount) || math.Abs(amount) > math.MaxInt64/100 {
+		return Record{}, fmt.Errorf("%w: amount %v", ErrMalformed, amount)
+	}
+
+	return Record{CID: cid, Cents: int64(math.Round(amount * 100)), RequestedAt: t.UTC(), Processor: processor}, nil
+}
+
+// Amount returns the amount in currency units.
+func (r Record) Amount() float64 {
+	return float64(r.Cents) / 100
+}
+
+// Append appends the version 1 encoding of r to dst.
+func Append(dst []byte, r Record) ([]byte, error) {
+	id, ok := processorIDs[r.Processor]
+	if !ok {
+		return dst, fmt.Errorf("%w: processor %q", ErrNotEncodable, r.Processor)
+	}
+
+	var uuid [16]byte
+	if !parseUUID(&uuid, r.CID) {
+		return dst, fmt.Errorf("%w: correlationId %q", ErrNotEncodable, r.CID)
+	}
+
+	if r.RequestedAt.Before(minTime) || r.RequestedAt.After(maxTime) {
+		return dst, fmt.Errorf("%w: requestedAt %s", ErrNotEncodable, r.RequestedAt)
+	}
+
+	dst = append(dst, Version1)
+	dst = append(dst, uuid[:]...)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(r.Cents))
+	dst = binary.BigEndian.AppendUint64(dst, uint64(r.RequestedAt.UnixNano()))
+	dst = append(dst, id)
+
+	return dst, nil
+}
+
+// Decode reads a record in either encoding. It takes a string since that is what Redis replies
+// hold.
+func Decode(s string) (Record, error) {
+	if IsBinary(s) {
+		return decodeV1(s)
+	}
+
+	return decodeText(s)
+}
+
+// IsBinary reports whether s is in the binary encoding, as opposed to text.
+func IsBinary(s string) bool {
+	return len(s) > 0 && s[0] == Version1
+}
+
+func decodeV1(b string) (Record, error) {
+	if len(b) != Size {
+		return Record{}, fmt.Errorf("%w: %d bytes, want %d", ErrMalformed, len(b), Size)
+	}
+
+	id := b[Size-1]
+	if int(id) >= len(processorNames) || processorNames[id] == "" {
+		return Record{}, fmt.Errorf("%w: processor id %d", ErrMalformed, id)
+	}
+
+	return Record{
+		CID:         formatUUID(b[1:17]),
+		Cents:       int64(binary.BigEndian.Uint64([]byte(b[17:25]))),
+		RequestedAt: time.Unix(0, int64(binary.BigEndian.Uint64([]byte(b[25:33])))).UTC(),
+		Processor:   processorNames[id],
+	}, nil
+}
+
+func decodeText(s string) (Record, error) {
+	fields := strings.Split(s, "|")
+	if len(fields) != 4 {
+		return Record{}, fmt.Errorf("%w: %d fields, want 4", ErrMalformed, len(fields))
+	}
+
+	amount, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: amount: %v", ErrMalformed, err)
+	}
+
+	return New(fields[0], amount, fields[2], fields[3])
+}
+
+// IsUUID reports whether s is a UUID in the canonical lowercase form the binary format holds.
+func IsUUID(s string) bool {
+	var uuid [16]byte
+	return parseUUID(&uuid, s)
+}
+
+// parseUUID decodes a UUID in its canonical lowercase form only, so that formatting it back gives
+// the same correlationId.
+func parseUUID(dst *[16]byte, s string) bool {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return false
+	}
+
+	j := 0
+	for _, i := range [...]int{0, 2, 4, 6, 9, 11, 14, 16, 19, 21, 24, 26, 28, 30, 32, 34} {
+		hi, ok1 := fromHex(s[i])
+		lo, ok2 := fromHex(s[i+1])
+		if !ok1 || !ok2 {
+			return false
+		}
+
+		dst[j] = hi<<4 | lo
+		j++
+	}
+
+	return true
+}
+
+func fromHex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	}
+
+	return 0, false
+}
+
+func formatUUID(b string) string {
+	var buf [36]byte
+
+	hex.Encode(buf[0:8], []byte(b[0:4]))
+	buf[8] = '-'
+	hex.Encode(buf[9:13], []byte(b[4:6]))
+	buf[13] = '-'
+	hex.Encode(buf[14:18], []byte(b[6:8]))
+	buf[18] = '-'
+	hex.Encode(buf[19:23], []byte(b[8:10]))
+	buf[23] = '-'
+	hex.Encode(buf[24:], []byte(b[10:]))
+
+	return string(buf[:])
+}
@@ -0,0 +1,118 @@
+package record
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendText appends the text encoding of r, as the stores write payments the binary format
+// cannot hold.
+func appendText(dst []byte, r Record) []byte {
+	dst = append(dst, r.CID...)
+	dst = append(dst, '|')
+	dst = strconv.AppendFloat(dst, r.Amount(), 'f', -1, 64)
+	dst = append(dst, '|')
+	dst = r.RequestedAt.AppendFormat(dst, time.RFC3339Nano)
+	dst = append(dst, '|')
+	dst = append(dst, r.Processor...)
+
+	return dst
+}
+
+func sameRecord(a, b Record) bool {
+	return a.CID == b.CID && a.Cents == b.Cents && a.RequestedAt.Equal(b.RequestedAt) && a.Processor == b.Processor
+}
+
+func FuzzDecode(f *testing.F) {
+	r, err := New("4a7f3c2e-9b1d-4e8a-a3c5-6f2b8d9e0c1a", 19.9, "2025-07-15T12:34:56.789Z", "default")
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	v1, err := Append(nil, r)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(string(v1))
+	f.Add(string(v1[:Size-1]))
+	f.Add(string(v1) + "x")
+	f.Add("\x02" + string(v1[1:]))
+	f.Add(string(v1[:Size-1]) + "\x03")
+	f.Add(string(appendText(nil, r)))
+	f.Add("not-a-uuid|10.5|2025-07-15T12:34:56Z|fallback")
+	f.Add("4a7f3c2e-9b1d-4e8a-a3c5-6f2b8d9e0c1a|NaN|2025-07-15T12:34:56Z|default")
+	f.Add("4a7f3c2e-9b1d-4e8a-a3c5-6f2b8d9e0c1a|1|0001-01-01T00:00:00Z|default")
+	f.Add("a|b|c")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		r, err := Decode(s)
+
+		if IsBinary(s) {
+			if len(s) != Size {
+				if !errors.Is(err, ErrMalformed) {
+					t.Fatalf("%d byte binary record: got error %v, want ErrMalformed", len(s), err)
+				}
+				return
+			}
+
+			if err != nil {
+				if !errors.Is(err, ErrMalformed) {
+					t.Fatalf("got error %v, want ErrMalformed", err)
+				}
+				return
+			}
+
+			// Every valid version 1 record encodes back to the same bytes.
+			b, err := Append(nil, r)
+			if err != nil {
+				t.Fatalf("decoded record %+v does not encode: %v", r, err)
+			}
+
+			if string(b) != s {
+				t.Fatalf("round trip changed the record: %x, want %x", b, s)
+			}
+			return
+		}
+
+		if err != nil {
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatalf("got error %v, want ErrMalformed", err)
+			}
+			return
+		}
+
+		// A text record holding a payment the binary format takes round-trips through it.
+		if b, err := Append(nil, r); err == nil {
+			got, err := Decode(string(b))
+			if err != nil {
+				t.Fatalf("encoded record does not decode: %v", err)
+			}
+
+			if !sameRecord(got, r) {
+				t.Fatalf("binary round trip: got %+v, want %+v", got, r)
+			}
+		} else if !errors.Is(err, ErrNotEncodable) {
+			t.Fatalf("got error %v, want ErrNotEncodable", err)
+		}
+
+		// And through text, when its amount is exact in a float64 and its correlationId cannot be
+		// taken for a binary record or another field.
+		if r.Cents > 1<<50 || r.Cents < -1<<50 || IsBinary(r.CID) || strings.ContainsRune(r.CID, '|') || strings.ContainsRune(r.Processor, '|') {
+			return
+		}
+
+		got, err := Decode(string(appendText(nil, r)))
+		if err != nil {
+			t.Fatalf("text record of %+v does not decode: %v", r, err)
+		}
+
+		if !sameRecord(got, r) {
+			t.Fatalf("text round trip: got %+v, want %+v", got, r)
+		}
+	})
+}
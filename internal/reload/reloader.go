@@ -0,0 +1,132 @@
+package reload
+
+import (
+	"github.com/anthdm/hollywood/actor"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/actors"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/config"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/healthy"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Reloader re-reads the configuration and pushes the tunables that changed to the actors and the
+// health checker. Settings outside config.Tunables are only reported, since they need a restart.
+type Reloader struct {
+	mu              sync.Mutex
+	path            string
+	current         config.Config
+	engine          *actor.Engine
+	retryActor      *actor.PID
+	retryConfig     *atomic.Pointer[messages.RetryConfigChanged]
+	processorPool   *actors.Pool
+	integrityPool   *actors.Pool
+	processorConfig *atomic.Pointer[messages.ProcessorConfigChanged]
+	checker         *healthy.Checker
+}
+
+// New creates a reloader. retryConfig and processorConfig are shared with the actors, which read
+// them when they start: the changes sent to the running actors do not reach those started later.
+func New(
+	path string,
+	current config.Config,
+	engine *actor.Engine,
+	retryActor *actor.PID,
+	retryConfig *atomic.Pointer[messages.RetryConfigChanged],
+	processorPool, integrityPool *actors.Pool,
+	processorConfig *atomic.Pointer[messages.ProcessorConfigChanged],
+	checker *healthy.Checker,
+) *Reloader {
+	return &Reloader{
+		path:            path,
+		current:         current,
+		engine:          engine,
+		retryActor:      retryActor,
+		retryConfig:     retryConfig,
+		processorPool:   processorPool,
+		integrityPool:   integrityPool,
+		processorConfig: processorConfig,
+		checker:         checker,
+	}
+}
+
+// Reload loads the configuration again and applies it. An invalid configuration is rejected as a
+// whole and the running one is kept.
+func (r *Reloader) Reload() (config.Tunables, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := config.Load(r.path)
+	if err != nil {
+		return r.current.Tunables(), err
+	}
+
+	if changed := r.current.RestartRequired(next); len(changed) > 0 {
+		slog.Warn("Settings changed but require a restart", slog.String("settings", strings.Join(changed, ", ")))
+	}
+
+	prev, tunables := r.current.Tunables(), next.Tunables()
+
+	if prev.RetryInterval != tunables.RetryInterval ||
+		prev.RetryBase != tunables.RetryBase ||
+		prev.RetryMultiplier != tunables.RetryMultiplier ||
+		prev.MaxBackoffDelay != tunables.MaxBackoffDelay ||
+		prev.RetryMaxAttempts != tunables.RetryMaxAttempts ||
+		prev.RetryJitter != tunables.RetryJitter ||
+		prev.RetryPolicies != tunables.RetryPolicies {
+		// Load validated the policies already.
+		policies, _ := tunables.Retry()
+
+		msg := messages.RetryConfigChanged{
+			Interval: tunables.RetryInterval,
+			Policies: policies,
+		}
+
+		r.retryConfig.Store(&msg)
+		r.engine.Send(r.retryActor, msg)
+	}
+
+	if prev.ReadTimeout != tunables.ReadTimeout || prev.WriteTimeout != tunables.WriteTimeout {
+		msg := messages.ProcessorConfigChanged{
+			ReadTimeout:  tunables.ReadTimeout,
+			WriteTimeout: tunables.WriteTimeout,
+		}
+
+		r.processorConfig.Store(&msg)
+		r.processorPool.Broadcast(msg)
+		r.integrityPool.Broadcast(msg)
+	}
+
+	if prev.MaxLatency != tunables.MaxLatency ||
+		prev.FailingGracePeriod != tunables.FailingGracePeriod ||
+		prev.FallbackLatencyFactor != tunables.FallbackLatencyFactor {
+		r.checker.OnConfigChanged(messages.RoutingConfigChanged{
+			MaxLatency:            tunables.MaxLatency,
+			FailingGracePeriod:    tunables.FailingGracePeriod,
+			FallbackLatencyFactor: tunables.FallbackLatencyFactor,
+		})
+	}
+
+	// Keep the settings that need a restart as they are running, so they are reported again
+	// until the process is restarted.
+	r.current = r.current.WithTunables(tunables)
+
+	slog.Warn("Configuration reloaded",
+		slog.Duration("retryInterval", tunables.RetryInterval),
+		slog.Duration("retryBase", tunables.RetryBase),
+		slog.Float64("retryMultiplier", tunables.RetryMultiplier),
+		slog.Duration("maxBackoffDelay", tunables.MaxBackoffDelay),
+		slog.Int("retryMaxAttempts", tunables.RetryMaxAttempts),
+		slog.String("retryJitter", tunables.RetryJitter),
+		slog.String("retryPolicies", tunables.RetryPolicies),
+		slog.Duration("maxLatency", tunables.MaxLatency),
+		slog.Duration("readTimeout", tunables.ReadTimeout),
+		slog.Duration("writeTimeout", tunables.WriteTimeout),
+		slog.Duration("failingGracePeriod", tunables.FailingGracePeriod),
+		slog.Float64("fallbackLatencyFactor", tunables.FallbackLatencyFactor),
+	)
+
+	return tunables, nil
+}
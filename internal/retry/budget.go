@@ -0,0 +1,105 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket refilled continuously at rate tokens per second, up to burst tokens.
+type bucket struct {
+	tokens float64
+	burst  float64
+	rate   float64
+	last   time.Time
+}
+
+func newBucket(rate, burst float64) bucket {
+	return bucket{tokens: burst, burst: burst, rate: rate, last: time.Now()}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+func (b *bucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Budget limits retries to a share of the traffic that is going through. Each first attempt that
+// succeeds deposits Ratio of a retry, and a token bucket allows a minimum of retries per second with
+// bursts on top, so retries can still start while nothing succeeds. After an outage the retries
+// ramp up along with the live traffic instead of all firing at once.
+type Budget struct {
+	mu      sync.Mutex
+	ratio   float64
+	deposit float64
+	cap     float64
+	bucket  bucket
+}
+
+// NewBudget creates a budget that allows ratio retries per successful first attempt, plus
+// minPerSecond retries per second with bursts of up to burst retries.
+func NewBudget(ratio, minPerSecond float64, burst int) *Budget {
+	return &Budget{
+		ratio:  ratio,
+		cap:    float64(burst),
+		bucket: newBucket(minPerSecond, float64(burst)),
+	}
+}
+
+// Success records a first attempt that went through.
+func (b *Budget) Success() {
+	b.mu.Lock()
+	b.deposit = min(b.cap, b.deposit+b.ratio)
+	b.mu.Unlock()
+}
+
+// Withdraw takes one retry from the budget, reporting whether there was one left.
+func (b *Budget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.deposit >= 1 {
+		b.deposit--
+		return true
+	}
+
+	return b.bucket.take(time.Now())
+}
+
+// Available returns the number of retries the budget would currently allow.
+func (b *Budget) Available() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bucket.refill(time.Now())
+
+	return b.deposit + b.bucket.tokens
+}
+
+// Pacer spreads work over time: it allows up to rate operations per second, with bursts of up to
+// burst. It is not safe for concurrent use.
+type Pacer struct {
+	bucket bucket
+}
+
+func NewPacer(rate float64, burst int) *Pacer {
+	return &Pacer{bucket: newBucket(rate, float64(burst))}
+}
+
+// Allow reports whether one more operation may run now.
+func (p *Pacer) Allow() bool {
+	return p.bucket.take(time.Now())
+}
+
+// Return gives back the token of an operation Allow let through but that did not run.
+func (p *Pacer) Return() {
+	p.bucket.tokens = min(p.bucket.burst, p.bucket.tokens+1)
+}
@@ -0,0 +1,114 @@
+package retry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"no time elapsed", 0, 0, 0},
+		{"half a second", 0, 500 * time.Millisecond, 5},
+		{"refill up to burst", 2, 10 * time.Second, 20},
+		{"partial tokens", 1, 150 * time.Millisecond, 2.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := bucket{tokens: tt.tokens, burst: 20, rate: 10, last: start}
+			b.refill(start.Add(tt.elapsed))
+
+			if diff := b.tokens - tt.want; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("got %v tokens, want %v", b.tokens, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	start := time.Now()
+	b := bucket{tokens: 1.5, burst: 2, rate: 10, last: start}
+
+	if !b.take(start) {
+		t.Fatal("first take: want a token")
+	}
+
+	if b.take(start) {
+		t.Fatal("second take: half a token left, want none")
+	}
+
+	if !b.take(start.Add(50 * time.Millisecond)) {
+		t.Fatal("take after the refill: want a token")
+	}
+}
+
+func TestBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		ratio     float64
+		burst     int
+		successes int
+		want      int
+	}{
+		{"burst only", 0.5, 3, 0, 3},
+		{"deposits add up", 0.5, 3, 4, 5},
+		{"fractions do not count", 0.3, 1, 3, 1},
+		{"deposit capped at burst", 1, 2, 100, 4},
+		{"no ratio", 0, 2, 100, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No refill, so only the burst and the deposits allow retries.
+			b := NewBudget(tt.ratio, 0, tt.burst)
+			for range tt.successes {
+				b.Success()
+			}
+
+			got := 0
+			for b.Withdraw() {
+				got++
+			}
+
+			if got != tt.want {
+				t.Errorf("got %d retries, want %d", got, tt.want)
+			}
+
+			if b.Available() >= 1 {
+				t.Errorf("got %v available after the budget ran out", b.Available())
+			}
+		})
+	}
+}
+
+func TestPacerReturn(t *testing.T) {
+	p := NewPacer(0, 1)
+
+	if !p.Allow() {
+		t.Fatal("want the burst token")
+	}
+
+	p.Return()
+
+	if !p.Allow() {
+		t.Fatal("want the returned token")
+	}
+
+	if p.Allow() {
+		t.Fatal("want no token left")
+	}
+
+	p.Return()
+	p.Return()
+
+	if !p.Allow() || p.Allow() {
+		t.Fatal("returned tokens must not exceed the burst")
+	}
+}
@@ -0,0 +1,249 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/outcome"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	JitterNone         = "none"
+	JitterFull         = "full"
+	JitterEqual        = "equal"
+	JitterDecorrelated = "decorrelated"
+)
+
+var processors = []string{"default", "fallback"}
+
+// Policy describes how long to wait before each retry of a failed payment and when to give up.
+type Policy struct {
+	Base       time.Duration
+	Multiplier float64
+	Max        time.Duration
+	// MaxAttempts caps the number of calls made for a payment, the first one included. 0 means
+	// no limit.
+	MaxAttempts int
+	Jitter      string
+}
+
+// Exhausted reports whether a payment that already made attempts calls may not be retried again.
+func (p Policy) Exhausted(attempts int) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// Delay returns the wait before retry number attempt, starting at 1. prev is the previous delay,
+// only used by decorrelated jitter.
+func (p Policy) Delay(attempt int, prev time.Duration) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	if p.Jitter == JitterDecorrelated {
+		// sleep = min(max, random between base and 3 * prev)
+		upper := max(3*prev, p.Base+1)
+		return min(p.Base+randDuration(upper-p.Base), p.Max)
+	}
+
+	exp := float64(p.Base) * math.Pow(p.Multiplier, float64(attempt-1))
+	delay := p.Max
+	if exp < float64(p.Max) {
+		delay = time.Duration(exp)
+	}
+
+	switch p.Jitter {
+	case JitterFull:
+		return randDuration(delay)
+	case JitterEqual:
+		return delay/2 + randDuration(delay/2)
+	}
+
+	return delay
+}
+
+func (p Policy) validate() error {
+	var errs []error
+
+	if p.Base <= 0 {
+		errs = append(errs, fmt.Errorf("base must be positive, got %s", p.Base))
+	}
+
+	if p.Multiplier < 1 {
+		errs = append(errs, fmt.Errorf("multiplier must be at least 1, got %v", p.Multiplier))
+	}
+
+	if p.Max < p.Base {
+		errs = append(errs, fmt.Errorf("max must be at least base, got %s", p.Max))
+	}
+
+	if p.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("maxAttempts must not be negative, got %d", p.MaxAttempts))
+	}
+
+	switch p.Jitter {
+	case JitterNone, JitterFull, JitterEqual, JitterDecorrelated:
+	default:
+		errs = append(errs, fmt.Errorf("jitter must be one of none, full, equal, decorrelated, got %q", p.Jitter))
+	}
+
+	return errors.Join(errs...)
+}
+
+func randDuration(n time.Duration) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(n)))
+}
+
+// Policies selects the policy for a failure. The most specific match wins: processor and failure
+// class, then failure class, then processor, then the default.
+type Policies struct {
+	Default     Policy
+	byBoth      map[string]Policy
+	byClass     map[outcome.Outcome]Policy
+	byProcessor map[string]Policy
+}
+
+func (ps Policies) For(processor string, o outcome.Outcome) Policy {
+	if p, ok := ps.byBoth[processor+"/"+o.String()]; ok {
+		return p
+	}
+
+	if p, ok := ps.byClass[o]; ok {
+		return p
+	}
+
+	if p, ok := ps.byProcessor[processor]; ok {
+		return p
+	}
+
+	return ps.Default
+}
+
+// Parse builds Policies from the default policy and a spec of overrides separated by ";". Each
+// override is a selector and a list of settings replacing those of the default, as in
+//
+//	rate_limited: base=200ms, max=5s; fallback/server_error: maxAttempts=5, jitter=full
+//
+// A selector is a failure class (see outcome.Outcome), a processor, or processor/class. Settings
+// are base, multiplier, max, maxAttempts and jitter.
+func Parse(def Policy, spec string) (Policies, error) {
+	if err := def.validate(); err != nil {
+		return Policies{}, fmt.Errorf("default policy: %w", err)
+	}
+
+	ps := Policies{
+		Default:     def,
+		byBoth:      map[string]Policy{},
+		byClass:     map[outcome.Outcome]Policy{},
+		byProcessor: map[string]Policy{},
+	}
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		selector, settings, ok := strings.Cut(entry, ":")
+		if !ok {
+			return Policies{}, fmt.Errorf("policy %q: missing ':' after the selector", entry)
+		}
+
+		selector = strings.TrimSpace(selector)
+
+		p, err := parseSettings(def, settings)
+		if err != nil {
+			return Policies{}, fmt.Errorf("policy %s: %w", selector, err)
+		}
+
+		if err := ps.add(selector, p); err != nil {
+			return Policies{}, err
+		}
+	}
+
+	return ps, nil
+}
+
+func (ps Policies) add(selector string, p Policy) error {
+	if processor, class, ok := strings.Cut(selector, "/"); ok {
+		if !isProcessor(processor) {
+			return fmt.Errorf("policy %s: unknown processor %q", selector, processor)
+		}
+
+		o, err := outcome.Parse(class)
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", selector, err)
+		}
+
+		ps.byBoth[processor+"/"+o.String()] = p
+		return nil
+	}
+
+	if isProcessor(selector) {
+		ps.byProcessor[selector] = p
+		return nil
+	}
+
+	o, err := outcome.Parse(selector)
+	if err != nil {
+		return fmt.Errorf("policy %s: selector must be a failure class, a processor or processor/class", selector)
+	}
+
+	ps.byClass[o] = p
+	return nil
+}
+
+func parseSettings(p Policy, settings string) (Policy, error) {
+	for _, kv := range strings.Split(settings, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return p, fmt.Errorf("setting %q: expected key=value", kv)
+		}
+
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "base":
+			p.Base, err = time.ParseDuration(value)
+		case "max":
+			p.Max, err = time.ParseDuration(value)
+		case "multiplier":
+			p.Multiplier, err = strconv.ParseFloat(value, 64)
+		case "maxAttempts":
+			p.MaxAttempts, err = strconv.Atoi(value)
+		case "jitter":
+			p.Jitter = value
+		default:
+			return p, fmt.Errorf("unknown setting %q", key)
+		}
+
+		if err != nil {
+			return p, fmt.Errorf("setting %s: %w", key, err)
+		}
+	}
+
+	return p, p.validate()
+}
+
+func isProcessor(name string) bool {
+	for _, p := range processors {
+		if p == name {
+			return true
+		}
+	}
+
+	return false
+}
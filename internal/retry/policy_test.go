@@ -0,0 +1,121 @@
+package retry
+
+import (
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/outcome"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDefault = Policy{
+	Base:        10 * time.Millisecond,
+	Multiplier:  2,
+	Max:         time.Second,
+	MaxAttempts: 0,
+	Jitter:      JitterNone,
+}
+
+func TestParse(t *testing.T) {
+	rateLimited := testDefault
+	rateLimited.Base, rateLimited.Max = 200*time.Millisecond, 5*time.Second
+
+	fallback := testDefault
+	fallback.MaxAttempts = 3
+
+	fallbackServerError := testDefault
+	fallbackServerError.MaxAttempts, fallbackServerError.Jitter = 5, JitterFull
+
+	spec := " rate_limited: base=200ms, max=5s; fallback: maxAttempts=3 ;fallback/server_error: maxAttempts=5, jitter=full; "
+
+	ps, err := Parse(testDefault, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		processor string
+		outcome   outcome.Outcome
+		want      Policy
+	}{
+		{"default", outcome.ServerError, testDefault},
+		{"default", outcome.RateLimited, rateLimited},
+		{"fallback", outcome.RateLimited, rateLimited},
+		{"fallback", outcome.ConnectionError, fallback},
+		{"fallback", outcome.ServerError, fallbackServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.processor+"/"+tt.outcome.String(), func(t *testing.T) {
+			if got := ps.For(tt.processor, tt.outcome); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		def  Policy
+		spec string
+		want string
+	}{
+		{"invalid default", Policy{Base: 0, Multiplier: 2, Max: time.Second, Jitter: JitterNone}, "", "default policy: base must be positive"},
+		{"missing colon", testDefault, "rate_limited base=1s", "missing ':'"},
+		{"unknown selector", testDefault, "slow: base=1s", "selector must be"},
+		{"unknown processor", testDefault, "primary/server_error: base=1s", `unknown processor "primary"`},
+		{"unknown class", testDefault, "default/broken: base=1s", `unknown outcome "broken"`},
+		{"missing value", testDefault, "rate_limited: base", "expected key=value"},
+		{"unknown setting", testDefault, "rate_limited: delay=1s", `unknown setting "delay"`},
+		{"invalid duration", testDefault, "rate_limited: base=fast", "setting base"},
+		{"invalid number", testDefault, "rate_limited: maxAttempts=many", "setting maxAttempts"},
+		{"unknown jitter", testDefault, "rate_limited: jitter=some", "jitter must be one of"},
+		{"max below base", testDefault, "rate_limited: base=2s", "max must be at least base"},
+		{"multiplier below one", testDefault, "fallback: multiplier=0.5", "multiplier must be at least 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.def, tt.spec)
+			if err == nil {
+				t.Fatalf("got no error, want one containing %q", tt.want)
+			}
+
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{4, 80 * time.Millisecond},
+		{8, time.Second},
+		{100, time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := testDefault.Delay(tt.attempt, 0); got != tt.want {
+			t.Errorf("attempt %d: got %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyExhausted(t *testing.T) {
+	p := testDefault
+	if p.Exhausted(1000) {
+		t.Error("a policy without maxAttempts is never exhausted")
+	}
+
+	p.MaxAttempts = 3
+	if p.Exhausted(2) || !p.Exhausted(3) {
+		t.Error("a policy with maxAttempts=3 is exhausted after the third attempt")
+	}
+}
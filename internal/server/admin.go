@@ -0,0 +1,457 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/buger/jsonparser"
+	goJson "github.com/goccy/go-json"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/actors"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/config"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/healthy"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/logging"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/storage"
+	"github.com/valyala/fasthttp"
+	"log/slog"
+	"time"
+)
+
+var (
+	adminPathPrefix  = []byte("/admin/")
+	adminTokenHeader = "X-Admin-Token"
+	logLevelPath     = "/admin/log-level"
+	reloadPath       = "/admin/reload"
+	processorPath    = "/admin/processor"
+	reconcilePath    = "/admin/reconcile"
+	verifyPath       = "/admin/verify"
+	poolPath         = "/admin/pool"
+	migratePath      = "/admin/migrate"
+	archivesPath     = "/admin/archives"
+
+	defaultVerifyLimit = 100
+
+	maintenanceTimeout = 5 * time.Minute
+
+	defaultOverrideTTL = 5 * time.Minute
+	maxOverrideTTL     = time.Hour
+)
+
+// Reloader applies a new configuration without restarting the process.
+type Reloader interface {
+	Reload() (config.Tunables, error)
+}
+
+type logLevelResponse struct {
+	Level string `json:"level"`
+}
+
+type processorResponse struct {
+	Chosen    string            `json:"chosen"`
+	Effective string            `json:"effective"`
+	Override  *healthy.Override `json:"override,omitempty"`
+}
+
+type poolResponse struct {
+	Size    int                 `json:"size"`
+	Members []actors.MemberLoad `json:"members"`
+}
+
+type exportedPayment struct {
+	CID         string  `json:"correlationId"`
+	Amount      float64 `json:"amount"`
+	RequestedAt string  `json:"requestedAt"`
+	Processor   string  `json:"processor"`
+}
+
+type verifyRequest struct {
+	CIDs   []string   `json:"correlationIds"`
+	From   *time.Time `json:"from"`
+	To     *time.Time `json:"to"`
+	Limit  int        `json:"limit"`
+	Repair bool       `json:"repair"`
+}
+
+type reloadResponse struct {
+	RetryInterval         string  `json:"retryInterval"`
+	MaxBackoffDelay       string  `json:"maxBackoffDelay"`
+	MaxLatency            string  `json:"maxLatency"`
+	ReadTimeout           string  `json:"readTimeout"`
+	WriteTimeout          string  `json:"writeTimeout"`
+	FailingGracePeriod    string  `json:"failingGracePeriod"`
+	FallbackLatencyFactor float64 `json:"fallbackLatencyFactor"`
+}
+
+// handleAdmin serves the operational endpoints. They are disabled unless an admin token is configured.
+func (h *Handler) handleAdmin(ctx *fasthttp.RequestCtx) {
+	if h.adminToken == "" {
+		ctx.Error("Not Found", fasthttp.StatusNotFound)
+		return
+	}
+
+	token := ctx.Request.Header.Peek(adminTokenHeader)
+	if subtle.ConstantTimeCompare(token, []byte(h.adminToken)) != 1 {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+
+	switch string(ctx.Path()) {
+	case logLevelPath:
+		h.handleLogLevel(ctx)
+	case reloadPath:
+		h.handleReload(ctx)
+	case processorPath:
+		h.handleProcessor(ctx)
+	case reconcilePath:
+		h.handleReconcile(ctx)
+	case verifyPath:
+		h.handleVerify(ctx)
+	case poolPath:
+		h.handlePool(ctx)
+	case migratePath:
+		h.handleMigrate(ctx)
+	case archivesPath:
+		h.handleArchives(ctx)
+	default:
+		ctx.Error("Not Found", fasthttp.StatusNotFound)
+	}
+}
+
+// handleLogLevel reports the current log level on GET and changes it on PUT/POST, reading the
+// new level from the "level" query argument or a {"level": "..."} body.
+func (h *Handler) handleLogLevel(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Method()) {
+	case fasthttp.MethodGet:
+	case fasthttp.MethodPut, fasthttp.MethodPost:
+		level := adminArg(ctx, "level")
+
+		if err := logging.SetLevel(level); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		slog.Warn("Log level changed", slog.String("level", logging.Level().String()))
+	default:
+		ctx.Error("Method Not Allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(ctx, logLevelResponse{Level: logging.Level().String()})
+}
+
+// handleReload re-reads the configuration, as SIGHUP does, and returns the tunables now in effect.
+func (h *Handler) handleReload(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.Error("Method Not Allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	t, err := h.reloader.Reload()
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	writeJSON(ctx, reloadResponse{
+		RetryInterval:         t.RetryInterval.String(),
+		MaxBackoffDelay:       t.MaxBackoffDelay.String(),
+		MaxLatency:            t.MaxLatency.String(),
+		ReadTimeout:           t.ReadTimeout.String(),
+		WriteTimeout:          t.WriteTimeout.String(),
+		FailingGracePeriod:    t.FailingGracePeriod.String(),
+		FallbackLatencyFactor: t.FallbackLatencyFactor,
+	})
+}
+
+// handleProcessor reports the routing state on GET. On POST it sets a manual override for every
+// pod, read from the "mode", "processor" and "ttl" query arguments or JSON body fields:
+// force or drain a processor, pause all dispatch, or return to auto.
+func (h *Handler) handleProcessor(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Method()) {
+	case fasthttp.MethodGet:
+	case fasthttp.MethodPost:
+		mode := adminArg(ctx, "mode")
+		processor := adminArg(ctx, "processor")
+
+		ttl := defaultOverrideTTL
+		if raw := adminArg(ctx, "ttl"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				ctx.Error("invalid ttl: "+err.Error(), fasthttp.StatusBadRequest)
+				return
+			}
+
+			ttl = d
+		}
+
+		if ttl > maxOverrideTTL {
+			ctx.Error("ttl must not exceed "+maxOverrideTTL.String(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		o, err := healthy.NewOverride(mode, processor, ttl)
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		if err := h.checker.SetOverride(o); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+
+		slog.Warn("Processor override requested", slog.String("mode", o.Mode), slog.String("processor", o.Processor), slog.Duration("ttl", ttl))
+	default:
+		ctx.Error("Method Not Allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := processorResponse{Chosen: h.checker.ChosenProcessor()}
+	resp.Effective, _ = h.checker.GetPaymentProcessor()
+	if o, ok := h.checker.Override(); ok {
+		resp.Override = &o
+	}
+
+	writeJSON(ctx, resp)
+}
+
+// handlePool reports the queue depth of each processor actor on GET. On POST it adds or removes a
+// member, read from the "action" query argument or JSON body field.
+func (h *Handler) handlePool(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Method()) {
+	case fasthttp.MethodGet:
+	case fasthttp.MethodPost:
+		switch action := adminArg(ctx, "action"); action {
+		case "add":
+			h.processorActorPool.Add()
+		case "remove":
+			if !h.processorActorPool.Remove() {
+				ctx.Error("pool must keep at least one member", fasthttp.StatusConflict)
+				return
+			}
+		default:
+			ctx.Error("action must be add or remove", fasthttp.StatusBadRequest)
+			return
+		}
+
+		slog.Warn("Processor pool resized", slog.Int("size", h.processorActorPool.Size()))
+	default:
+		ctx.Error("Method Not Allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(ctx, poolResponse{Size: h.processorActorPool.Size(), Members: h.processorActorPool.Loads()})
+}
+
+// handleReconcile compares our records with the processors' admin summaries for the "from" and
+// "to" range (RFC3339), defaulting to the last minute.
+func (h *Handler) handleReconcile(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		ctx.Error("Method Not Allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	to := time.Now().UTC()
+	from := to.Add(-time.Minute)
+
+	if raw := adminArg(ctx, "from"); raw != "" {
+		t, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			ctx.Error("invalid from: "+err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		from = t
+	}
+
+	if raw := adminArg(ctx, "to"); raw != "" {
+		t, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			ctx.Error("invalid to: "+err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		to = t
+	}
+
+	report, err := h.reconciler.Run(from, to)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(ctx, report)
+}
+
+// handleVerify checks payments against the processor lookup endpoint: the correlationIds in the
+// body if any, otherwise up to "limit" random payments requested in the from/to range (the last
+// five minutes by default). With "repair", lost payments are recorded and denied ones quarantined.
+func (h *Handler) handleVerify(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.Error("Method Not Allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	var req verifyRequest
+	if body := ctx.PostBody(); len(body) > 0 {
+		if err := goJson.Unmarshal(body, &req); err != nil {
+			ctx.Error("invalid body: "+err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(req.CIDs) > 0 {
+		report, err := h.reconciler.VerifyCIDs(req.CIDs, req.Repair)
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(ctx, report)
+		return
+	}
+
+	to := time.Now().UTC()
+	if req.To != nil {
+		to = *req.To
+	}
+
+	from := to.Add(-5 * time.Minute)
+	if req.From != nil {
+		from = *req.From
+	}
+
+	if req.Limit <= 0 {
+		req.Limit = defaultVerifyLimit
+	}
+
+	report, err := h.reconciler.VerifyRange(from, to, req.Limit, req.Repair)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(ctx, report)
+}
+
+// handleMigrate rewrites the stored payments still kept as text in the binary format.
+func (h *Handler) handleMigrate(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.Error("Method Not Allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	if res, ok := h.maintain(ctx, messages.MigratePayments{}); ok {
+		writeJSON(ctx, res)
+	}
+}
+
+// handleArchives lists the archived days on GET, or with action=export returns the payments
+// archived before the "before" cutoff, a date or an RFC3339 time. On POST, action=archive moves
+// the payments requested before it into archives, and compact or drop apply to the archives of the
+// days before it.
+func (h *Handler) handleArchives(ctx *fasthttp.RequestCtx) {
+	action := adminArg(ctx, "action")
+
+	if ctx.IsGet() && action == "" {
+		if res, ok := h.maintain(ctx, messages.ListArchives{}); ok {
+			writeJSON(ctx, res)
+		}
+
+		return
+	}
+
+	if !ctx.IsGet() && !ctx.IsPost() {
+		ctx.Error("Method Not Allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	raw := adminArg(ctx, "before")
+	if raw == "" {
+		ctx.Error("before must be set", fasthttp.StatusBadRequest)
+		return
+	}
+
+	before, err := time.Parse(storage.DayLayout, raw)
+	if err != nil {
+		before, err = time.Parse(time.RFC3339Nano, raw)
+	}
+
+	if err != nil {
+		ctx.Error("invalid before: "+err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	var msg any
+	switch {
+	case ctx.IsGet() && action == "export":
+		msg = messages.ExportArchives{Before: before}
+	case ctx.IsPost() && action == "archive":
+		msg = messages.ArchivePayments{Before: before}
+	case ctx.IsPost() && action == "compact":
+		msg = messages.CompactArchives{Before: before}
+	case ctx.IsPost() && action == "drop":
+		msg = messages.DropArchives{Before: before}
+	default:
+		ctx.Error("action must be export on GET, or archive, compact or drop on POST", fasthttp.StatusBadRequest)
+		return
+	}
+
+	res, ok := h.maintain(ctx, msg)
+	if !ok {
+		return
+	}
+
+	if exported, ok := res.(messages.ExportedArchives); ok {
+		payments := make([]exportedPayment, len(exported.Payments))
+		for i, p := range exported.Payments {
+			payments[i] = exportedPayment{CID: p.Payment.CID, Amount: p.Payment.Amount, RequestedAt: p.Payment.RequestedAt, Processor: p.ProcessedBy}
+		}
+
+		res = payments
+	}
+
+	writeJSON(ctx, res)
+}
+
+// maintain asks the maintenance actor to run a task, writing the error response if it fails.
+func (h *Handler) maintain(ctx *fasthttp.RequestCtx, msg any) (any, bool) {
+	res, err := h.engine.Request(h.maintenanceActor, msg, maintenanceTimeout).Result()
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return nil, false
+	}
+
+	if err, ok := res.(error); ok {
+		status := fasthttp.StatusInternalServerError
+		if errors.Is(err, storage.ErrArchivesUnsupported) {
+			status = fasthttp.StatusNotImplemented
+		}
+
+		ctx.Error(err.Error(), status)
+		return nil, false
+	}
+
+	return res, true
+}
+
+// adminArg reads an admin parameter from the query string, falling back to the JSON body.
+func adminArg(ctx *fasthttp.RequestCtx, key string) string {
+	if v := ctx.QueryArgs().Peek(key); len(v) > 0 {
+		return string(v)
+	}
+
+	v, _ := jsonparser.GetString(ctx.PostBody(), key)
+	return v
+}
+
+func writeJSON(ctx *fasthttp.RequestCtx, v any) {
+	body, err := goJson.Marshal(v)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
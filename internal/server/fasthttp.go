@@ -1,14 +1,22 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/anthdm/hollywood/actor"
 	"github.com/buger/jsonparser"
 	goJson "github.com/goccy/go-json"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/actors"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/healthy"
 	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/reconcile"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/tracing"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/prefork"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
 	"time"
 )
@@ -17,15 +25,31 @@ var (
 	processPaymentPath = "/payments"
 	purgePaymentsPath  = "/purge-payments"
 	summaryPath        = "/payments-summary"
+	metricsPath        = "/metrics"
 )
 
 type Handler struct {
 	processorActorPool *actors.Pool
 	dbActor            *actor.PID
+	maintenanceActor   *actor.PID
 	engine             *actor.Engine
+	metricsHandler     fasthttp.RequestHandler
+	adminToken         string
+	reloader           Reloader
+	checker            *healthy.Checker
+	reconciler         *reconcile.Reconciler
 }
 
 func (h *Handler) handler(ctx *fasthttp.RequestCtx) {
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		defer logRequest(ctx, time.Now())
+	}
+
+	if bytes.HasPrefix(ctx.Path(), adminPathPrefix) {
+		h.handleAdmin(ctx)
+		return
+	}
+
 	switch string(ctx.Method()) {
 	case fasthttp.MethodPost:
 		h.handlePost(ctx)
@@ -59,15 +83,18 @@ func (h *Handler) handleProcessPayment(ctx *fasthttp.RequestCtx) {
 	cid, _ := jsonparser.GetString(body, "correlationId")
 	amount, _ := jsonparser.GetFloat(body, "amount")
 
-	pid := h.processorActorPool.GetActor(cid)
+	span := tracing.StartFromRequest(&ctx.Request, "payment.accept", trace.WithAttributes(attribute.String("payment.correlation_id", cid)))
+	defer span.End()
 
-	h.engine.Send(pid, messages.ProcessPayment{
+	h.processorActorPool.Send(cid, messages.ProcessPayment{
 		Payment: messages.Payment{
 			CID:    cid,
 			Amount: amount,
 		},
+		Trace: span.SpanContext(),
 	})
 
+	metrics.PaymentsAccepted.Inc()
 	ctx.SetStatusCode(fasthttp.StatusAccepted)
 }
 
@@ -85,6 +112,11 @@ func (h *Handler) handleGet(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if path == metricsPath {
+		h.metricsHandler(ctx)
+		return
+	}
+
 	ctx.Error("Not Found", fasthttp.StatusNotFound)
 	return
 }
@@ -115,6 +147,7 @@ func (h *Handler) handleGetSummary(ctx *fasthttp.RequestCtx) {
 			TotalRequests: summaryResp.Fallback.TotalRequests,
 			TotalAmount:   summaryResp.Fallback.TotalAmount,
 		},
+		Incomplete: summaryResp.Incomplete,
 	})
 
 	//bodyResp, _ := goJson.Marshal(messages.SummarizedPayments{})
@@ -124,11 +157,20 @@ func (h *Handler) handleGetSummary(ctx *fasthttp.RequestCtx) {
 	ctx.SetBody(bodyResp)
 }
 
+func logRequest(ctx *fasthttp.RequestCtx, start time.Time) {
+	slog.LogAttrs(context.Background(), slog.LevelDebug, "Request handled",
+		slog.String("method", string(ctx.Method())),
+		slog.String("path", string(ctx.Path())),
+		slog.Int("status", ctx.Response.StatusCode()),
+		slog.Duration("duration", time.Since(start)),
+	)
+}
+
 func buildMessage(c *fasthttp.RequestCtx) messages.SummarizePayments {
 	from := c.QueryArgs().Peek("from")
 	to := c.QueryArgs().Peek("to")
 
-	slog.Info("Summary received: ", from, "-", to)
+	slog.Info("Summary received", slog.String("from", string(from)), slog.String("to", string(to)))
 	summaryReq := messages.SummarizePayments{}
 
 	pFrom, err := time.Parse(time.RFC3339, string(from))
@@ -169,13 +211,23 @@ func (s *Server) Start(port int) {
 func New(
 	engine *actor.Engine,
 	processorPool *actors.Pool,
-	dbActor *actor.PID,
+	dbActor, maintenanceActor *actor.PID,
 	usePreFork bool,
+	adminToken string,
+	reloader Reloader,
+	checker *healthy.Checker,
+	reconciler *reconcile.Reconciler,
 ) *Server {
 	h := &Handler{
 		processorActorPool: processorPool,
 		dbActor:            dbActor,
+		maintenanceActor:   maintenanceActor,
 		engine:             engine,
+		metricsHandler:     metrics.Handler(),
+		adminToken:         adminToken,
+		reloader:           reloader,
+		checker:            checker,
+		reconciler:         reconciler,
 	}
 
 	s := &fasthttp.Server{
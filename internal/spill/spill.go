@@ -0,0 +1,243 @@
+package spill
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	goJson "github.com/goccy/go-json"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/metrics"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const fileName = "payments.jsonl"
+
+// record is how a payment is kept on disk.
+type record struct {
+	CID         string    `json:"cid"`
+	Amount      float64   `json:"amount"`
+	RequestedAt string    `json:"requestedAt"`
+	ProcessedBy string    `json:"processedBy"`
+	ProcessedAt time.Time `json:"processedAt"`
+	Tries       int       `json:"tries"`
+}
+
+// Buffer holds processed payments that could not be stored yet. Up to memoryLimit of them are kept
+// in memory and the rest appended to a file, which also keeps them across a restart: payments
+// found in the file on Open are stored again, which is harmless since storing is idempotent.
+// It is safe for concurrent use.
+type Buffer struct {
+	mu          sync.Mutex
+	mem         []messages.PushPayment
+	memoryLimit int
+
+	file   *os.File
+	offset int64
+	onDisk int
+}
+
+// Open creates the spill buffer, loading the payments left on disk in dir by a previous run.
+func Open(dir string, memoryLimit int) (*Buffer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating spill directory: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, fileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening spill file: %w", err)
+	}
+
+	b := &Buffer{memoryLimit: memoryLimit, file: file}
+
+	count, end, err := countLines(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("reading spill file: %w", err)
+	}
+
+	// A record cut short by a crash would be glued to the next one written.
+	if err := file.Truncate(end); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("truncating spill file: %w", err)
+	}
+
+	b.onDisk = count
+
+	b.observe()
+
+	return b, nil
+}
+
+// Push adds payments to the buffer. Those that do not fit in memory go to disk; if the disk fails
+// too, they are kept in memory anyway and the error is returned.
+func (b *Buffer) Push(payments []messages.PushPayment) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.observe()
+
+	room := max(0, b.memoryLimit-len(b.mem))
+	if len(payments) <= room {
+		b.mem = append(b.mem, payments...)
+		return nil
+	}
+
+	b.mem = append(b.mem, payments[:room]...)
+	overflow := payments[room:]
+
+	if err := b.write(overflow); err != nil {
+		b.mem = append(b.mem, overflow...)
+		return err
+	}
+
+	b.onDisk += len(overflow)
+
+	return nil
+}
+
+func (b *Buffer) write(payments []messages.PushPayment) error {
+	var buf bytes.Buffer
+
+	enc := goJson.NewEncoder(&buf)
+	for _, p := range payments {
+		_ = enc.Encode(record{
+			CID:         p.Payment.CID,
+			Amount:      p.Payment.Amount,
+			RequestedAt: p.Payment.RequestedAt,
+			ProcessedBy: p.ProcessedBy,
+			ProcessedAt: p.ProcessedAt,
+			Tries:       p.Tries,
+		})
+	}
+
+	if _, err := b.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("writing spill file: %w", err)
+	}
+
+	return b.file.Sync()
+}
+
+// Take removes up to n payments from the buffer, from memory first. The caller pushes them back
+// if it fails to store them.
+func (b *Buffer) Take(n int) ([]messages.PushPayment, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.observe()
+
+	if len(b.mem) > 0 {
+		n = min(n, len(b.mem))
+		taken := make([]messages.PushPayment, n)
+		copy(taken, b.mem[len(b.mem)-n:])
+		clear(b.mem[len(b.mem)-n:])
+		b.mem = b.mem[:len(b.mem)-n]
+
+		return taken, nil
+	}
+
+	if b.onDisk == 0 {
+		return nil, nil
+	}
+
+	taken, read, err := b.read(n)
+	if err != nil {
+		return nil, err
+	}
+
+	b.offset += read
+	b.onDisk -= len(taken)
+
+	if b.onDisk == 0 {
+		if err := b.file.Truncate(0); err != nil {
+			return taken, fmt.Errorf("truncating spill file: %w", err)
+		}
+
+		b.offset = 0
+	}
+
+	return taken, nil
+}
+
+// read decodes up to n records from the current offset, returning them and the bytes consumed.
+func (b *Buffer) read(n int) ([]messages.PushPayment, int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(b.file, b.offset, 1<<62))
+
+	var taken []messages.PushPayment
+	var read int64
+
+	for len(taken) < n {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading spill file: %w", err)
+		}
+
+		read += int64(len(line))
+
+		var rec record
+		if err := goJson.Unmarshal(line, &rec); err != nil {
+			slog.Error("Skipping unreadable spilled payment", slog.Int64("offset", b.offset+read-int64(len(line))), slog.String("error", err.Error()))
+			b.onDisk--
+			continue
+		}
+
+		taken = append(taken, messages.PushPayment{
+			Payment: messages.Payment{
+				CID:         rec.CID,
+				Amount:      rec.Amount,
+				RequestedAt: rec.RequestedAt,
+			},
+			ProcessedBy: rec.ProcessedBy,
+			ProcessedAt: rec.ProcessedAt,
+			Tries:       rec.Tries,
+		})
+	}
+
+	return taken, read, nil
+}
+
+// Len returns the number of payments waiting in the buffer.
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.mem) + b.onDisk
+}
+
+func (b *Buffer) observe() {
+	metrics.SpilledPayments.WithLabelValues("memory").Set(float64(len(b.mem)))
+	metrics.SpilledPayments.WithLabelValues("disk").Set(float64(b.onDisk))
+}
+
+// countLines returns the number of complete lines in r and the offset right after the last one.
+func countLines(r io.Reader) (int, int64, error) {
+	var count int
+	var pos, end int64
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			count += bytes.Count(buf[:n], []byte{'\n'})
+			end = pos + int64(i) + 1
+		}
+
+		pos += int64(n)
+
+		if errors.Is(err, io.EOF) {
+			return count, end, nil
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/record"
+	"io"
+	"time"
+)
+
+// DayLayout names the day of an archive.
+const DayLayout = time.DateOnly
+
+var ErrArchivesUnsupported = errors.New("storage backend does not support archives")
+
+// Archiver is implemented by stores that can move old payments out of the live ones into
+// immutable per-day archives. Scan still goes through the archives, so summaries cover both.
+// Archiving a day again, for payments stored late, adds a part to it; compacting merges the parts.
+// Cutoffs are rounded down to the start of their day, in UTC.
+type Archiver interface {
+	Archive(ctx context.Context, before time.Time) (messages.ArchivedPayments, error)
+	Archives(ctx context.Context) ([]messages.Archive, error)
+	Export(ctx context.Context, before time.Time, fn func(record.Record)) error
+	Compact(ctx context.Context, before time.Time) (messages.CompactedArchives, error)
+	Drop(ctx context.Context, before time.Time) (messages.DroppedArchives, error)
+}
+
+// StartOfDay returns the start of the UTC day of t.
+func StartOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// encodeArchive compresses records, each prefixed with its length.
+func encodeArchive(records []string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+
+	var n [binary.MaxVarintLen64]byte
+	for _, r := range records {
+		if _, err := zw.Write(n[:binary.PutUvarint(n[:], uint64(len(r)))]); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.WriteString(zw, r); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeArchive calls fn with each record of an archive made by encodeArchive.
+func decodeArchive(archive string, fn func(string)) error {
+	zr, err := gzip.NewReader(bytes.NewReader([]byte(archive)))
+	if err != nil {
+		return fmt.Errorf("reading archive: %w", err)
+	}
+
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("reading archive: %w", err)
+	}
+
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return fmt.Errorf("reading archive: %w", record.ErrMalformed)
+		}
+
+		fn(string(data[n : n+int(size)]))
+		data = data[n+int(size):]
+	}
+
+	return nil
+}
@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/record"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	paymentsFile   = "payments.log"
+	quarantineFile = "quarantine.log"
+	deadLetterFile = "deadletter.log"
+
+	opStore  byte = 1
+	opDelete byte = 2
+
+	// frameHeader is the length of the data that follows, its CRC-32 and the operation.
+	frameHeader = 4 + 4 + 1
+)
+
+// File stores payments in a directory of the local disk, for a service running alone on one
+// machine. Payments are appended to a log, as frames holding their record, and the log is read
+// back into memory on OpenFile so reads never touch the disk. Quarantining a payment appends a
+// delete frame.
+type File struct {
+	mu         sync.RWMutex
+	payments   *os.File
+	quarantine *os.File
+	deadLetter *os.File
+	size       int64
+
+	records   []record.Record
+	index     map[string]int
+	malformed int
+}
+
+// OpenFile opens the store in dir, loading the payments stored by a previous run. A frame cut
+// short or damaged by a crash ends the log, and is dropped.
+func OpenFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating storage directory: %w", err)
+	}
+
+	s := &File{index: make(map[string]int)}
+
+	var err error
+	for _, f := range []struct {
+		file **os.File
+		name string
+	}{{&s.payments, paymentsFile}, {&s.quarantine, quarantineFile}, {&s.deadLetter, deadLetterFile}} {
+		*f.file, err = os.OpenFile(filepath.Join(dir, f.name), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("opening %s: %w", f.name, err)
+		}
+	}
+
+	if err := s.load(); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *File) load() error {
+	data, err := os.ReadFile(s.payments.Name())
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", paymentsFile, err)
+	}
+
+	// Consecutive deletes are applied together, before the next payment is stored.
+	deleted := make(map[string]struct{})
+	var end int64
+
+	for rest := data; len(rest) > 0; {
+		op, payload, n, ok := readFrame(rest)
+		if !ok {
+			slog.Warn("Dropping damaged end of the payments log", slog.Int64("offset", end), slog.Int("bytes", len(rest)))
+			break
+		}
+
+		rest = rest[n:]
+		end += int64(n)
+
+		switch op {
+		case opStore:
+			if len(deleted) > 0 {
+				s.remove(deleted)
+				clear(deleted)
+			}
+
+			r, err := record.Decode(string(payload))
+			if err != nil {
+				s.malformed++
+				continue
+			}
+
+			if _, ok := s.index[r.CID]; ok {
+				continue
+			}
+
+			s.index[r.CID] = len(s.records)
+			s.records = append(s.records, r)
+		case opDelete:
+			deleted[string(payload)] = struct{}{}
+		}
+	}
+
+	if len(deleted) > 0 {
+		s.remove(deleted)
+	}
+
+	if end < int64(len(data)) {
+		if err := s.payments.Truncate(end); err != nil {
+			return fmt.Errorf("truncating %s: %w", paymentsFile, err)
+		}
+	}
+
+	s.size = end
+
+	return nil
+}
+
+func (s *File) Store(_ context.Context, payments []messages.PushPayment) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := make([]bool, len(payments))
+	before, malformed := len(s.records), s.malformed
+
+	var buf, rec []byte
+	for i, msg := range payments {
+		if _, ok := s.index[msg.Payment.CID]; ok {
+			continue
+		}
+
+		rec = appendRecord(rec[:0], msg)
+		buf = appendFrame(buf, opStore, rec)
+		stored[i] = true
+
+		// Decoding the record gives the payment as it is read back from the log after a restart.
+		r, err := record.Decode(string(rec))
+		if err != nil {
+			s.malformed++
+			continue
+		}
+
+		s.index[r.CID] = len(s.records)
+		s.records = append(s.records, r)
+	}
+
+	if len(buf) == 0 {
+		return stored, nil
+	}
+
+	if err := s.append(buf); err != nil {
+		for _, r := range s.records[before:] {
+			delete(s.index, r.CID)
+		}
+
+		clear(s.records[before:])
+		s.records = s.records[:before]
+		s.malformed = malformed
+
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// append writes frames to the payments log. If that fails, the log is cut back so that what was
+// written of them is not taken for the start of the next frames.
+func (s *File) append(frames []byte) error {
+	if _, err := s.payments.Write(frames); err != nil {
+		_ = s.payments.Truncate(s.size)
+		return fmt.Errorf("writing %s: %w", paymentsFile, err)
+	}
+
+	if err := s.payments.Sync(); err != nil {
+		_ = s.payments.Truncate(s.size)
+		return fmt.Errorf("syncing %s: %w", paymentsFile, err)
+	}
+
+	s.size += int64(len(frames))
+
+	return nil
+}
+
+func (s *File) Scan(_ context.Context, _, _ *time.Time, fn func(record.Record)) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.records {
+		fn(r)
+	}
+
+	return s.malformed, nil
+}
+
+func (s *File) Quarantine(_ context.Context, cids []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]struct{}, len(cids))
+	var quarantined, deletes []byte
+
+	for _, cid := range cids {
+		i, ok := s.index[cid]
+		if !ok {
+			continue
+		}
+
+		if _, ok := wanted[cid]; ok {
+			continue
+		}
+
+		wanted[cid] = struct{}{}
+		quarantined = appendFrame(quarantined, opStore, encode(nil, s.records[i]))
+		deletes = appendFrame(deletes, opDelete, []byte(cid))
+	}
+
+	if len(wanted) == 0 {
+		return 0, nil
+	}
+
+	// Quarantined first: a crash in between leaves the payments in both places, not in neither.
+	if err := writeSync(s.quarantine, quarantined); err != nil {
+		return 0, fmt.Errorf("writing %s: %w", quarantineFile, err)
+	}
+
+	if err := s.append(deletes); err != nil {
+		return 0, err
+	}
+
+	s.remove(wanted)
+
+	return len(wanted), nil
+}
+
+// remove drops the records of the given correlationIds from memory, keeping the others in order.
+func (s *File) remove(cids map[string]struct{}) {
+	kept := s.records[:0]
+	for _, r := range s.records {
+		if _, ok := cids[r.CID]; ok {
+			delete(s.index, r.CID)
+			continue
+		}
+
+		s.index[r.CID] = len(kept)
+		kept = append(kept, r)
+	}
+
+	clear(s.records[len(kept):])
+	s.records = kept
+}
+
+func (s *File) DeadLetter(_ context.Context, msg messages.DeadLetterPayment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := writeSync(s.deadLetter, []byte(deadLetterRecord(msg)+"\n")); err != nil {
+		return fmt.Errorf("writing %s: %w", deadLetterFile, err)
+	}
+
+	return nil
+}
+
+// Migrate has nothing to do: the log has only ever held the current formats.
+func (s *File) Migrate(context.Context) (messages.MigratedPayments, error) {
+	return messages.MigratedPayments{}, nil
+}
+
+func (s *File) Purge(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range []*os.File{s.payments, s.quarantine, s.deadLetter} {
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("truncating %s: %w", filepath.Base(f.Name()), err)
+		}
+	}
+
+	s.size = 0
+	s.records = nil
+	s.malformed = 0
+	clear(s.index)
+
+	return nil
+}
+
+func (s *File) close() {
+	for _, f := range []*os.File{s.payments, s.quarantine, s.deadLetter} {
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+}
+
+func writeSync(f *os.File, b []byte) error {
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// appendFrame appends a frame of op holding data to dst.
+func appendFrame(dst []byte, op byte, data []byte) []byte {
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(data)))
+	dst = append(dst, 0, 0, 0, 0, op)
+	dst = append(dst, data...)
+
+	binary.BigEndian.PutUint32(dst[start+4:], crc32.ChecksumIEEE(dst[start+frameHeader-1:]))
+
+	return dst
+}
+
+// readFrame reads the frame at the start of b, returning its operation, its data and its length.
+// It fails when the frame is incomplete or does not match its checksum.
+func readFrame(b []byte) (byte, []byte, int, bool) {
+	if len(b) < frameHeader {
+		return 0, nil, 0, false
+	}
+
+	n := frameHeader + int(binary.BigEndian.Uint32(b))
+	if n < frameHeader || len(b) < n {
+		return 0, nil, 0, false
+	}
+
+	body := b[frameHeader-1 : n]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[4:]) {
+		return 0, nil, 0, false
+	}
+
+	return body[0], body[1:], n, true
+}
+
+// encode appends r to dst, as appendRecord does for the payment it was read from.
+func encode(dst []byte, r record.Record) []byte {
+	if b, err := record.Append(dst, r); err == nil {
+		return b
+	}
+
+	dst = append(dst, r.CID...)
+	dst = append(dst, '|')
+	dst = strconv.AppendFloat(dst, r.Amount(), 'f', -1, 64)
+	dst = append(dst, '|')
+	dst = r.RequestedAt.AppendFormat(dst, time.RFC3339Nano)
+	dst = append(dst, '|')
+	dst = append(dst, r.Processor...)
+
+	return dst
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/record"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	frame := appendFrame(nil, opStore, []byte("payload"))
+	next := appendFrame(nil, opDelete, []byte("cid"))
+
+	flip := func(i int) []byte {
+		b := append([]byte(nil), frame...)
+		b[i] ^= 0xff
+		return b
+	}
+
+	tests := []struct {
+		name   string
+		b      []byte
+		wantOp byte
+		want   string
+		wantN  int
+		wantOK bool
+	}{
+		{name: "frame", b: frame, wantOp: opStore, want: "payload", wantN: len(frame), wantOK: true},
+		{name: "followed by another", b: append(append([]byte(nil), frame...), next...), wantOp: opStore, want: "payload", wantN: len(frame), wantOK: true},
+		{name: "empty data", b: appendFrame(nil, opDelete, nil), wantOp: opDelete, want: "", wantN: frameHeader, wantOK: true},
+		{name: "empty", b: nil},
+		{name: "header cut short", b: frame[:frameHeader-1]},
+		{name: "data cut short", b: frame[:len(frame)-1]},
+		{name: "length too large", b: flip(0)},
+		{name: "checksum damaged", b: flip(5)},
+		{name: "operation damaged", b: flip(frameHeader - 1)},
+		{name: "data damaged", b: flip(frameHeader + 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op, data, n, ok := readFrame(tt.b)
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %v, want %v", ok, tt.wantOK)
+			}
+
+			if !ok {
+				return
+			}
+
+			if op != tt.wantOp || string(data) != tt.want || n != tt.wantN {
+				t.Errorf("got op %d, data %q, length %d, want op %d, data %q, length %d", op, data, n, tt.wantOp, tt.want, tt.wantN)
+			}
+		})
+	}
+}
+
+func testPayments(n int) []messages.PushPayment {
+	payments := make([]messages.PushPayment, n)
+	for i := range payments {
+		payments[i] = messages.PushPayment{
+			Payment: messages.Payment{
+				CID:         fmt.Sprintf("4a7f3c2e-9b1d-4e8a-a3c5-%012d", i),
+				Amount:      19.9,
+				RequestedAt: fmt.Sprintf("2025-07-15T12:00:%02d.5Z", i),
+			},
+			ProcessedBy: "default",
+		}
+	}
+
+	return payments
+}
+
+func scanCIDs(t *testing.T, s *File) ([]string, int) {
+	t.Helper()
+
+	var cids []string
+	malformed, err := s.Scan(context.Background(), nil, nil, func(r record.Record) {
+		cids = append(cids, r.CID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cids, malformed
+}
+
+func TestOpenFileRecovery(t *testing.T) {
+	payments := testPayments(4)
+	frame := appendFrame(nil, opStore, appendRecord(nil, payments[3]))
+
+	tests := []struct {
+		name string
+		// damage changes the log after the first three payments were stored and the second one
+		// quarantined.
+		damage func(log []byte) []byte
+		want   []string
+	}{
+		{
+			name:   "intact",
+			damage: func(log []byte) []byte { return log },
+			want:   []string{payments[0].Payment.CID, payments[2].Payment.CID},
+		},
+		{
+			name:   "frame cut short",
+			damage: func(log []byte) []byte { return append(log, frame[:len(frame)-3]...) },
+			want:   []string{payments[0].Payment.CID, payments[2].Payment.CID},
+		},
+		{
+			name:   "header cut short",
+			damage: func(log []byte) []byte { return append(log, frame[:4]...) },
+			want:   []string{payments[0].Payment.CID, payments[2].Payment.CID},
+		},
+		{
+			name: "damaged frame in the middle",
+			damage: func(log []byte) []byte {
+				// The second frame holds the second payment: it and everything after it is lost,
+				// the delete included.
+				n := len(frame)
+				log[n+frameHeader+3] ^= 0xff
+				return log
+			},
+			want: []string{payments[0].Payment.CID},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, paymentsFile)
+
+			s, err := OpenFile(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := s.Store(context.Background(), payments[:3]); err != nil {
+				t.Fatal(err)
+			}
+
+			if n, err := s.Quarantine(context.Background(), []string{payments[1].Payment.CID}); err != nil || n != 1 {
+				t.Fatalf("quarantined %d, error %v", n, err)
+			}
+
+			s.close()
+
+			log, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			damaged := tt.damage(log)
+			if err := os.WriteFile(path, damaged, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = OpenFile(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+
+			if got, _ := scanCIDs(t, s); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+
+			// The damaged end is cut off, so that what is stored next can be read back.
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.Size() != s.size || s.size > int64(len(damaged)) {
+				t.Fatalf("log is %d bytes, store expects %d", info.Size(), s.size)
+			}
+
+			stored, err := s.Store(context.Background(), payments[3:])
+			if err != nil || !stored[0] {
+				t.Fatalf("stored %v, error %v", stored, err)
+			}
+
+			s.close()
+
+			s, err = OpenFile(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := append(tt.want, payments[3].Payment.CID)
+			if got, _ := scanCIDs(t, s); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("after storing again: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestOpenFileMalformedRecord(t *testing.T) {
+	dir := t.TempDir()
+	payments := testPayments(2)
+
+	var log []byte
+	log = appendFrame(log, opStore, appendRecord(nil, payments[0]))
+	log = appendFrame(log, opStore, []byte("not|a|record"))
+	log = appendFrame(log, opStore, appendRecord(nil, payments[1]))
+
+	if err := os.WriteFile(filepath.Join(dir, paymentsFile), log, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	// A frame that reads back fine but holds no record is skipped, not taken for the end of the log.
+	cids, malformed := scanCIDs(t, s)
+	if len(cids) != 2 || malformed != 1 {
+		t.Fatalf("got %v and %d malformed, want both payments and 1 malformed", cids, malformed)
+	}
+}
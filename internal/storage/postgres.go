@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/record"
+	"github.com/shopspring/decimal"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// postgresSchema creates the tables of the store, as scripts/docker/init.sql does for the databases
+// of docker compose. The payments table is the one of the payment processors, plus the processor
+// each payment went to.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS payments (
+    correlationId UUID PRIMARY KEY,
+    amount DECIMAL NOT NULL,
+    requested_at TIMESTAMP NOT NULL,
+    processor TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS payments_requested_at ON payments (requested_at);
+
+CREATE TABLE IF NOT EXISTS quarantined_payments (LIKE payments INCLUDING DEFAULTS);
+
+CREATE TABLE IF NOT EXISTS dead_letter_payments (
+    correlationId TEXT NOT NULL,
+    amount DECIMAL NOT NULL,
+    requested_at TEXT NOT NULL,
+    processor TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+`
+
+// insertPayments stores a batch in one statement, one array per column. Payments already stored
+// are skipped, and the correlationIds of those stored returned.
+const insertPayments = `
+INSERT INTO payments (correlationId, amount, requested_at, processor)
+SELECT c::uuid, a::numeric, t, p FROM unnest($1::text[], $2::text[], $3::timestamp[], $4::text[]) AS u (c, a, t, p)
+ON CONFLICT (correlationId) DO NOTHING
+RETURNING correlationId::text`
+
+var errNotUUID = errors.New("correlationId is not a UUID")
+
+// Postgres stores payments in PostgreSQL, where every instance of the service sees them.
+type Postgres struct {
+	pool *pgxpool.Pool
+}
+
+// OpenPostgres connects to the database at dsn, with up to maxConns connections, and creates the
+// tables of the store if they do not exist.
+func OpenPostgres(ctx context.Context, dsn string, maxConns int) (*Postgres, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parsing postgres dsn: %w", err)
+	}
+
+	cfg.MaxConns = int32(maxConns)
+
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+
+	if _, err := pool.Exec(ctx, postgresSchema); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("creating postgres schema: %w", err)
+	}
+
+	return &Postgres{pool: pool}, nil
+}
+
+// Store inserts the batch in one statement. Payments the table cannot hold, whose correlationId is
+// not a UUID or requestedAt not a timestamp, are dead lettered instead of failing the batch.
+func (s *Postgres) Store(ctx context.Context, payments []messages.PushPayment) ([]bool, error) {
+	cids := make([]string, 0, len(payments))
+	amounts := make([]string, 0, len(payments))
+	requestedAts := make([]time.Time, 0, len(payments))
+	processors := make([]string, 0, len(payments))
+
+	for _, msg := range payments {
+		r, err := record.New(msg.Payment.CID, msg.Payment.Amount, msg.Payment.RequestedAt, msg.ProcessedBy)
+		if err == nil && !record.IsUUID(r.CID) {
+			err = errNotUUID
+		}
+
+		if err != nil {
+			slog.Error("Payment cannot be stored, dead lettering", slog.String("correlationId", msg.Payment.CID), slog.String("error", err.Error()))
+
+			dl := messages.DeadLetterPayment{Payment: msg.Payment, Processor: msg.ProcessedBy, Reason: "not storable: " + err.Error()}
+			if err := s.DeadLetter(ctx, dl); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		// The uuid column gives correlationIds back in lowercase.
+		cids = append(cids, strings.ToLower(r.CID))
+		amounts = append(amounts, decimal.New(r.Cents, -2).String())
+		requestedAts = append(requestedAts, r.RequestedAt)
+		processors = append(processors, r.Processor)
+	}
+
+	stored := make([]bool, len(payments))
+	if len(cids) == 0 {
+		return stored, nil
+	}
+
+	rows, err := s.pool.Query(ctx, insertPayments, cids, amounts, requestedAts, processors)
+	if err != nil {
+		return nil, err
+	}
+
+	inserted, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	// A correlationId appearing twice in the batch is inserted once: only its first payment counts
+	// as stored.
+	fresh := make(map[string]bool, len(inserted))
+	for _, cid := range inserted {
+		fresh[cid] = true
+	}
+
+	for i, msg := range payments {
+		if cid := strings.ToLower(msg.Payment.CID); fresh[cid] {
+			stored[i] = true
+			delete(fresh, cid)
+		}
+	}
+
+	return stored, nil
+}
+
+func (s *Postgres) Scan(ctx context.Context, from, to *time.Time, fn func(record.Record)) (int, error) {
+	where, args := requestedWithin(from, to)
+
+	rows, err := s.pool.Query(ctx, "SELECT correlationId::text, (amount * 100)::bigint, requested_at, processor FROM payments"+
+		where+" ORDER BY requested_at", args...)
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	var r record.Record
+	for rows.Next() {
+		if err := rows.Scan(&r.CID, &r.Cents, &r.RequestedAt, &r.Processor); err != nil {
+			return 0, err
+		}
+
+		r.RequestedAt = r.RequestedAt.UTC()
+		fn(r)
+	}
+
+	return 0, rows.Err()
+}
+
+// Summarize adds the payments up in the database, using the requested_at index for the range.
+func (s *Postgres) Summarize(ctx context.Context, from, to *time.Time) (messages.SummarizedPayments, error) {
+	summary := messages.SummarizedPayments{}
+	where, args := requestedWithin(from, to)
+
+	rows, err := s.pool.Query(ctx, "SELECT processor, COUNT(*), COALESCE(SUM(amount), 0)::text FROM payments"+
+		where+" GROUP BY processor", args...)
+	if err != nil {
+		return summary, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var processor, total string
+		var count int64
+
+		if err := rows.Scan(&processor, &count, &total); err != nil {
+			return summary, err
+		}
+
+		amount, err := decimal.NewFromString(total)
+		if err != nil {
+			return summary, err
+		}
+
+		p := &summary.Fallback
+		if processor == "default" {
+			p = &summary.Default
+		}
+
+		p.TotalRequests += count
+		p.TotalAmount = p.TotalAmount.Add(amount)
+	}
+
+	return summary, rows.Err()
+}
+
+// requestedWithin returns the WHERE clause, and its arguments, of the payments requested within
+// the range. Each bound is left out when not set, so that the requested_at index can be used.
+func requestedWithin(from, to *time.Time) (string, []any) {
+	var where []string
+	var args []any
+
+	if from != nil {
+		args = append(args, from.UTC())
+		where = append(where, "requested_at >= $"+strconv.Itoa(len(args)))
+	}
+
+	if to != nil {
+		args = append(args, to.UTC())
+		where = append(where, "requested_at <= $"+strconv.Itoa(len(args)))
+	}
+
+	if len(where) == 0 {
+		return "", nil
+	}
+
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+func (s *Postgres) Quarantine(ctx context.Context, cids []string) (int, error) {
+	valid := make([]string, 0, len(cids))
+	for _, cid := range cids {
+		if record.IsUUID(cid) {
+			valid = append(valid, cid)
+		}
+	}
+
+	if len(valid) == 0 {
+		return 0, nil
+	}
+
+	tag, err := s.pool.Exec(ctx, `
+WITH moved AS (DELETE FROM payments WHERE correlationId = ANY($1::text[]::uuid[]) RETURNING *)
+INSERT INTO quarantined_payments SELECT * FROM moved`, valid)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+func (s *Postgres) DeadLetter(ctx context.Context, msg messages.DeadLetterPayment) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO dead_letter_payments (correlationId, amount, requested_at, processor, reason)
+VALUES ($1, $2::text::numeric, $3, $4, $5)`,
+		msg.Payment.CID, strconv.FormatFloat(msg.Payment.Amount, 'f', -1, 64), msg.Payment.RequestedAt, msg.Processor, msg.Reason)
+
+	return err
+}
+
+// Migrate has nothing to do: the tables have only ever held the current format.
+func (s *Postgres) Migrate(context.Context) (messages.MigratedPayments, error) {
+	return messages.MigratedPayments{}, nil
+}
+
+func (s *Postgres) Purge(ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, "TRUNCATE payments, quarantined_payments, dead_letter_payments")
+	return err
+}
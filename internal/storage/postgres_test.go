@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/record"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestPostgres opens the store on the database at POSTGRES_DSN, emptied, and skips the test
+// when it is not set. A database of scripts/docker/docker-compose.yaml will do. The tables are
+// shared, so these tests do not run in parallel.
+func openTestPostgres(t *testing.T) *Postgres {
+	t.Helper()
+
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN not set")
+	}
+
+	s, err := OpenPostgres(context.Background(), dsn, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Purge(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = s.Purge(context.Background())
+		s.pool.Close()
+	})
+
+	return s
+}
+
+func countRows(t *testing.T, s *Postgres, table string) int {
+	t.Helper()
+
+	var n int
+	if err := s.pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func scanPostgres(t *testing.T, s *Postgres, from, to *time.Time) []string {
+	t.Helper()
+
+	var cids []string
+	if _, err := s.Scan(context.Background(), from, to, func(r record.Record) {
+		cids = append(cids, r.CID)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return cids
+}
+
+// TestPostgresSchema keeps the tables created by the store and by scripts/docker/init.sql the same.
+func TestPostgresSchema(t *testing.T) {
+	b, err := os.ReadFile("../../scripts/docker/init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(l, "--") {
+			lines = append(lines, l)
+		}
+	}
+
+	if got, want := strings.TrimSpace(strings.Join(lines, "\n")), strings.TrimSpace(postgresSchema); got != want {
+		t.Errorf("init.sql creates\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPostgresStore(t *testing.T) {
+	s := openTestPostgres(t)
+	ctx := context.Background()
+	payments := testPayments(3)
+
+	notUUID := payments[0]
+	notUUID.Payment.CID = "not-a-uuid"
+
+	upper := testPayments(1)[0]
+	upper.Payment.CID = "4A7F3C2E-9B1D-4E8A-A3C5-00000000ABCD"
+	upper.Payment.RequestedAt = "2025-07-15T12:00:59.5Z"
+
+	tests := []struct {
+		name  string
+		batch []messages.PushPayment
+		want  []bool
+	}{
+		{"new payments", payments[:2], []bool{true, true}},
+		{"stored again", payments[:2], []bool{false, false}},
+		{"twice in a batch", []messages.PushPayment{payments[2], payments[1], payments[2]}, []bool{true, false, false}},
+		{"not storable", []messages.PushPayment{notUUID}, []bool{false}},
+		{"uppercase", []messages.PushPayment{upper}, []bool{true}},
+		{"uppercase stored again", []messages.PushPayment{upper}, []bool{false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, err := s.Store(ctx, tt.batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(stored) != fmt.Sprint(tt.want) {
+				t.Errorf("got stored %v, want %v", stored, tt.want)
+			}
+		})
+	}
+
+	var records []record.Record
+	if _, err := s.Scan(ctx, nil, nil, func(r record.Record) { records = append(records, r) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != len(payments)+1 {
+		t.Fatalf("got %d payments, want %d", len(records), len(payments)+1)
+	}
+
+	for i, r := range records[:len(payments)] {
+		p := payments[i]
+		want, _ := record.New(p.Payment.CID, p.Payment.Amount, p.Payment.RequestedAt, p.ProcessedBy)
+
+		if r.CID != want.CID || r.Cents != want.Cents || !r.RequestedAt.Equal(want.RequestedAt) || r.Processor != want.Processor {
+			t.Errorf("got %+v, want %+v", r, want)
+		}
+	}
+
+	if n := countRows(t, s, "dead_letter_payments"); n != 1 {
+		t.Errorf("got %d dead letters, want the payment that could not be stored", n)
+	}
+}
+
+func TestPostgresScanRange(t *testing.T) {
+	s := openTestPostgres(t)
+	payments := testPayments(5)
+
+	if _, err := s.Store(context.Background(), payments); err != nil {
+		t.Fatal(err)
+	}
+
+	// at returns the requestedAt of payment i, moved by d.
+	at := func(i int, d time.Duration) *time.Time {
+		t, _ := time.Parse(time.RFC3339Nano, payments[i].Payment.RequestedAt)
+		t = t.Add(d)
+		return &t
+	}
+
+	cids := func(from, to int) []string {
+		var out []string
+		for _, p := range payments[from:to] {
+			out = append(out, p.Payment.CID)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name     string
+		from, to *time.Time
+		want     []string
+	}{
+		{"unbounded", nil, nil, cids(0, 5)},
+		{"from", at(2, 0), nil, cids(2, 5)},
+		{"to", nil, at(1, 0), cids(0, 2)},
+		{"both, inclusive", at(1, 0), at(3, 0), cids(1, 4)},
+		{"between payments", at(1, time.Millisecond), at(2, -time.Millisecond), nil},
+		{"after every payment", at(4, time.Second), nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scanPostgres(t, s, tt.from, tt.to); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostgresQuarantine(t *testing.T) {
+	s := openTestPostgres(t)
+	ctx := context.Background()
+	payments := testPayments(3)
+
+	if _, err := s.Store(ctx, payments); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown and non-UUID correlationIds are ignored.
+	n, err := s.Quarantine(ctx, []string{payments[1].Payment.CID, "4a7f3c2e-9b1d-4e8a-a3c5-999999999999", "not-a-uuid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("got %d quarantined, want 1", n)
+	}
+
+	want := []string{payments[0].Payment.CID, payments[2].Payment.CID}
+	if got := scanPostgres(t, s, nil, nil); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v stored, want %v", got, want)
+	}
+
+	if n := countRows(t, s, "quarantined_payments"); n != 1 {
+		t.Errorf("got %d rows in quarantine, want 1", n)
+	}
+
+	// A quarantined payment is no longer stored, so it can be stored again.
+	stored, err := s.Store(ctx, payments[1:2])
+	if err != nil || !stored[0] {
+		t.Errorf("stored %v, error %v", stored, err)
+	}
+}
+
+func TestPostgresDeadLetterAndPurge(t *testing.T) {
+	s := openTestPostgres(t)
+	ctx := context.Background()
+	payments := testPayments(2)
+
+	if _, err := s.Store(ctx, payments); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Quarantine(ctx, []string{payments[0].Payment.CID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dead letters take payments as they were received, whatever they hold.
+	for _, p := range []messages.Payment{payments[1].Payment, {CID: "not-a-uuid", Amount: 0.1, RequestedAt: "yesterday"}} {
+		if err := s.DeadLetter(ctx, messages.DeadLetterPayment{Payment: p, Processor: "fallback", Reason: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reason, amount string
+	if err := s.pool.QueryRow(ctx, "SELECT reason, amount::text FROM dead_letter_payments WHERE correlationId = $1", payments[1].Payment.CID).Scan(&reason, &amount); err != nil {
+		t.Fatal(err)
+	}
+
+	if reason != "test" || amount != "19.9" {
+		t.Errorf("got reason %q and amount %s, want test and 19.9", reason, amount)
+	}
+
+	if err := s.Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"payments", "quarantined_payments", "dead_letter_payments"} {
+		if n := countRows(t, s, table); n != 0 {
+			t.Errorf("%s: got %d rows after purge", table, n)
+		}
+	}
+}
@@ -0,0 +1,618 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/record"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	bufPool = sync.Pool{
+		New: func() any {
+			b := make([]byte, 0, 64)
+			return &b
+		},
+	}
+
+	keyPaymentsAll = "payments:all"
+	// keyPaymentsStored holds the correlationId of every payment in payments:all or in an
+	// archive, so a batch written twice does not store its payments twice.
+	keyPaymentsStored     = "payments:cids"
+	keyPaymentsQuarantine = "payments:quarantine"
+	keyPaymentsDeadLetter = "payments:deadletter"
+	// keyArchives indexes the archive parts, hashes holding their records and how many there are,
+	// scored by the start of their day.
+	keyArchives       = "payments:archives"
+	keyArchiveSeq     = "payments:archives:seq"
+	archivePartPrefix = "payments:archive:"
+
+	migrateChunk = 500
+	archiveChunk = 50_000
+)
+
+var errArchivesChanged = errors.New("payments changed while archiving, try again")
+
+// storePayments appends each record whose correlationId was not stored yet, in one round trip.
+// ARGV alternates correlationIds and records; the reply tells, for each one, whether it was stored.
+var storePayments = redis.NewScript(`
+local stored = {}
+for i = 1, #ARGV, 2 do
+	if redis.call('SADD', KEYS[1], ARGV[i]) == 1 then
+		redis.call('RPUSH', KEYS[2], ARGV[i + 1])
+		stored[#stored + 1] = 1
+	else
+		stored[#stored + 1] = 0
+	end
+end
+return stored
+`)
+
+// migrateRecords replaces records of payments:all in place. ARGV holds index, old record, new
+// record and correlationId quadruples; a record that moved or changed since it was read is left
+// alone. The correlationIds are added to payments:cids, which records stored before it existed
+// are missing from. It returns how many records were replaced.
+var migrateRecords = redis.NewScript(`
+local migrated = 0
+for i = 1, #ARGV, 4 do
+	local index = tonumber(ARGV[i])
+	if redis.call('LINDEX', KEYS[1], index) == ARGV[i + 1] then
+		redis.call('LSET', KEYS[1], index, ARGV[i + 2])
+		redis.call('SADD', KEYS[2], ARGV[i + 3])
+		migrated = migrated + 1
+	end
+end
+return migrated
+`)
+
+// archivePayments moves the first ARGV[1] records of payments:all to new archive parts, provided
+// the last of them is still ARGV[2]: only other instances quarantining payments change what is
+// ahead of it. ARGV[3] archive parts follow, as day, score, count and records, then the records
+// that could not be read, which go to quarantine. The correlationIds stay in payments:cids, so
+// archived payments are not stored again.
+var archivePayments = redis.NewScript(`
+local n = tonumber(ARGV[1])
+if redis.call('LINDEX', KEYS[1], n - 1) ~= ARGV[2] then
+	return -1
+end
+local i = 4
+for _ = 1, tonumber(ARGV[3]) do
+	local key = ARGV[4 + 4 * tonumber(ARGV[3])] .. ARGV[i] .. ':' .. redis.call('INCR', KEYS[4])
+	redis.call('HSET', key, 'data', ARGV[i + 3], 'count', ARGV[i + 2])
+	redis.call('ZADD', KEYS[3], ARGV[i + 1], key)
+	i = i + 4
+end
+for j = i + 1, #ARGV do
+	redis.call('RPUSH', KEYS[2], ARGV[j])
+end
+redis.call('LTRIM', KEYS[1], n, -1)
+return n
+`)
+
+// replaceArchiveParts replaces the parts of a day, from ARGV[6] on, with a new one made of day,
+// score, count and records, unless one of them is gone.
+var replaceArchiveParts = redis.NewScript(`
+for i = 6, #ARGV do
+	if not redis.call('ZSCORE', KEYS[1], ARGV[i]) then
+		return -1
+	end
+end
+local key = ARGV[5] .. ARGV[1] .. ':' .. redis.call('INCR', KEYS[2])
+redis.call('HSET', key, 'data', ARGV[4], 'count', ARGV[3])
+redis.call('ZADD', KEYS[1], ARGV[2], key)
+for i = 6, #ARGV do
+	redis.call('ZREM', KEYS[1], ARGV[i])
+	redis.call('DEL', ARGV[i])
+end
+return 1
+`)
+
+// Redis stores payments in Redis, where every instance of the service sees them: records in the
+// payments:all list and their correlationIds in the payments:cids set.
+type Redis struct {
+	client *redis.Client
+}
+
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client}
+}
+
+func (s *Redis) Store(ctx context.Context, payments []messages.PushPayment) ([]bool, error) {
+	args := make([]any, 0, 2*len(payments))
+
+	bufPtr := bufPool.Get().(*[]byte)
+	for _, msg := range payments {
+		*bufPtr = appendRecord((*bufPtr)[:0], msg)
+		args = append(args, msg.Payment.CID, string(*bufPtr))
+	}
+
+	bufPool.Put(bufPtr)
+
+	res, err := storePayments.Run(ctx, s.client, []string{keyPaymentsStored, keyPaymentsAll}, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make([]bool, len(res))
+	for i, r := range res {
+		stored[i] = r == 1
+	}
+
+	return stored, nil
+}
+
+// Scan goes through the archived days within the range, then the live payments.
+func (s *Redis) Scan(ctx context.Context, from, to *time.Time, fn func(record.Record)) (int, error) {
+	lo, hi := "-inf", "+inf"
+	if from != nil {
+		lo = strconv.FormatInt(StartOfDay(*from).Unix(), 10)
+	}
+
+	if to != nil {
+		hi = strconv.FormatInt(to.Unix(), 10)
+	}
+
+	parts, err := s.parts(ctx, lo, hi)
+	if err != nil {
+		return 0, err
+	}
+
+	malformed := 0
+
+	for _, p := range parts {
+		err := s.readPart(ctx, p.key, func(line string) {
+			r, err := record.Decode(line)
+			if err != nil {
+				malformed++
+				return
+			}
+
+			fn(r)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	lines, err := s.client.LRange(ctx, keyPaymentsAll, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range lines {
+		r, err := record.Decode(line)
+		if err != nil {
+			malformed++
+			continue
+		}
+
+		fn(r)
+	}
+
+	return malformed, nil
+}
+
+func (s *Redis) Quarantine(ctx context.Context, cids []string) (int, error) {
+	lines, err := s.client.LRange(ctx, keyPaymentsAll, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	wanted := make(map[string]struct{}, len(cids))
+	for _, cid := range cids {
+		wanted[cid] = struct{}{}
+	}
+
+	pipe := s.client.TxPipeline()
+	moved := 0
+
+	for _, line := range lines {
+		r, err := record.Decode(line)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := wanted[r.CID]; !ok {
+			continue
+		}
+
+		pipe.LRem(ctx, keyPaymentsAll, 1, line)
+		pipe.RPush(ctx, keyPaymentsQuarantine, line)
+		moved++
+	}
+
+	if moved == 0 {
+		return 0, nil
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	return moved, nil
+}
+
+func (s *Redis) DeadLetter(ctx context.Context, msg messages.DeadLetterPayment) error {
+	return s.client.RPush(ctx, keyPaymentsDeadLetter, deadLetterRecord(msg)).Err()
+}
+
+// Migrate rewrites the text records of payments:all in the binary format, in chunks so that Redis
+// is not blocked for long. Payments keep their place in the list and records that cannot be
+// encoded stay as text, so it can run while payments are being stored, and again.
+func (s *Redis) Migrate(ctx context.Context) (messages.MigratedPayments, error) {
+	migrated := messages.MigratedPayments{}
+
+	lines, err := s.client.LRange(ctx, keyPaymentsAll, 0, -1).Result()
+	if err != nil {
+		return migrated, err
+	}
+
+	args := make([]any, 0, 4*migrateChunk)
+
+	flush := func() error {
+		if len(args) == 0 {
+			return nil
+		}
+
+		n, err := migrateRecords.Run(ctx, s.client, []string{keyPaymentsAll, keyPaymentsStored}, args...).Int()
+		if err != nil {
+			return err
+		}
+
+		migrated.Migrated += n
+		migrated.Skipped += len(args)/4 - n
+		args = args[:0]
+
+		return nil
+	}
+
+	for i, line := range lines {
+		if record.IsBinary(line) {
+			continue
+		}
+
+		r, err := record.Decode(line)
+		if err != nil {
+			migrated.Malformed++
+			continue
+		}
+
+		b, err := record.Append(nil, r)
+		if err != nil {
+			migrated.Skipped++
+			continue
+		}
+
+		args = append(args, i, line, string(b), r.CID)
+
+		if len(args) == 4*migrateChunk {
+			if err := flush(); err != nil {
+				return migrated, err
+			}
+		}
+	}
+
+	return migrated, flush()
+}
+
+func (s *Redis) Purge(ctx context.Context) error {
+	parts, err := s.parts(ctx, "-inf", "+inf")
+	if err != nil {
+		return err
+	}
+
+	keys := []string{keyPaymentsAll, keyPaymentsStored, keyPaymentsQuarantine, keyPaymentsDeadLetter, keyArchives, keyArchiveSeq}
+	for _, p := range parts {
+		keys = append(keys, p.key)
+	}
+
+	return s.client.Del(ctx, keys...).Err()
+}
+
+// archivePart is a part of the archive of a day.
+type archivePart struct {
+	key string
+	day time.Time
+}
+
+// parts returns the archive parts of the days whose start is within the lo/hi score range, in
+// the order of their days.
+func (s *Redis) parts(ctx context.Context, lo, hi string) ([]archivePart, error) {
+	res, err := s.client.ZRangeByScoreWithScores(ctx, keyArchives, &redis.ZRangeBy{Min: lo, Max: hi}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]archivePart, len(res))
+	for i, z := range res {
+		parts[i] = archivePart{key: z.Member.(string), day: time.Unix(int64(z.Score), 0).UTC()}
+	}
+
+	return parts, nil
+}
+
+// partsBefore returns the archive parts of the days before the one of cutoff.
+func (s *Redis) partsBefore(ctx context.Context, cutoff time.Time) ([]archivePart, error) {
+	return s.parts(ctx, "-inf", "("+strconv.FormatInt(StartOfDay(cutoff).Unix(), 10))
+}
+
+func (s *Redis) readPart(ctx context.Context, key string, fn func(string)) error {
+	data, err := s.client.HGet(ctx, key, "data").Result()
+	if err != nil {
+		return fmt.Errorf("reading archive %s: %w", key, err)
+	}
+
+	return decodeArchive(data, fn)
+}
+
+// Archive moves the payments requested before the day of before out of payments:all. Payments are
+// appended about when they are requested, so it takes them from the head of the list and stops at
+// the first one requested later: the few older ones stored after it are archived by a later run,
+// in a new part of their day. Records that cannot be read are moved to quarantine on the way.
+func (s *Redis) Archive(ctx context.Context, before time.Time) (messages.ArchivedPayments, error) {
+	cutoff := StartOfDay(before)
+	archived := messages.ArchivedPayments{}
+	days := make(map[string]struct{})
+
+	for {
+		lines, err := s.client.LRange(ctx, keyPaymentsAll, 0, int64(archiveChunk-1)).Result()
+		if err != nil {
+			return archived, err
+		}
+
+		var order []string
+		var malformed []any
+		byDay := make(map[string][]string)
+
+		n := 0
+		for _, line := range lines {
+			r, err := record.Decode(line)
+			if err != nil {
+				// Its day is unknown, but leaving it at the head would stop every run here.
+				malformed = append(malformed, line)
+				n++
+				continue
+			}
+
+			if !r.RequestedAt.Before(cutoff) {
+				break
+			}
+
+			day := r.RequestedAt.Format(DayLayout)
+			if _, ok := byDay[day]; !ok {
+				order = append(order, day)
+			}
+
+			byDay[day] = append(byDay[day], line)
+			n++
+		}
+
+		if n == 0 {
+			break
+		}
+
+		args := []any{n, lines[n-1], len(order)}
+		for _, day := range order {
+			blob, err := encodeArchive(byDay[day])
+			if err != nil {
+				return archived, err
+			}
+
+			start, _ := time.Parse(DayLayout, day)
+			args = append(args, day, start.Unix(), len(byDay[day]), blob)
+		}
+
+		args = append(args, archivePartPrefix)
+		args = append(args, malformed...)
+
+		res, err := archivePayments.Run(ctx, s.client, []string{keyPaymentsAll, keyPaymentsQuarantine, keyArchives, keyArchiveSeq}, args...).Int()
+		if err != nil {
+			return archived, err
+		}
+
+		if res < 0 {
+			return archived, errArchivesChanged
+		}
+
+		archived.Archived += n - len(malformed)
+		archived.Quarantined += len(malformed)
+		for _, day := range order {
+			if _, ok := days[day]; !ok {
+				days[day] = struct{}{}
+				archived.Days = append(archived.Days, day)
+			}
+		}
+
+		if n < len(lines) || len(lines) < archiveChunk {
+			break
+		}
+	}
+
+	return archived, nil
+}
+
+func (s *Redis) Archives(ctx context.Context) ([]messages.Archive, error) {
+	parts, err := s.parts(ctx, "-inf", "+inf")
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.client.Pipeline()
+	counts := make([]*redis.StringCmd, len(parts))
+	sizes := make([]*redis.IntCmd, len(parts))
+
+	for i, p := range parts {
+		counts[i] = pipe.HGet(ctx, p.key, "count")
+		sizes[i] = pipe.HStrLen(ctx, p.key, "data")
+	}
+
+	if len(parts) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var archives []messages.Archive
+	for i, p := range parts {
+		day := p.day.Format(DayLayout)
+		if len(archives) == 0 || archives[len(archives)-1].Day != day {
+			archives = append(archives, messages.Archive{Day: day})
+		}
+
+		count, _ := strconv.Atoi(counts[i].Val())
+
+		a := &archives[len(archives)-1]
+		a.Parts++
+		a.Payments += count
+		a.Bytes += sizes[i].Val()
+	}
+
+	return archives, nil
+}
+
+func (s *Redis) Export(ctx context.Context, before time.Time, fn func(record.Record)) error {
+	parts, err := s.partsBefore(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range parts {
+		err := s.readPart(ctx, p.key, func(line string) {
+			if r, err := record.Decode(line); err == nil {
+				fn(r)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compact merges the parts of each day into one, dropping the payments archived twice. A day in a
+// single part is only rewritten if it has duplicates.
+func (s *Redis) Compact(ctx context.Context, before time.Time) (messages.CompactedArchives, error) {
+	compacted := messages.CompactedArchives{}
+
+	parts, err := s.partsBefore(ctx, before)
+	if err != nil {
+		return compacted, err
+	}
+
+	for start := 0; start < len(parts); {
+		end := start + 1
+		for end < len(parts) && parts[end].day.Equal(parts[start].day) {
+			end++
+		}
+
+		day := parts[start:end]
+		start = end
+
+		seen := make(map[string]struct{})
+		var lines []string
+		duplicates := 0
+
+		for _, p := range day {
+			err := s.readPart(ctx, p.key, func(line string) {
+				key := line
+				if r, err := record.Decode(line); err == nil {
+					key = r.CID
+				}
+
+				if _, ok := seen[key]; ok {
+					duplicates++
+					return
+				}
+
+				seen[key] = struct{}{}
+				lines = append(lines, line)
+			})
+			if err != nil {
+				return compacted, err
+			}
+		}
+
+		if len(day) == 1 && duplicates == 0 {
+			continue
+		}
+
+		blob, err := encodeArchive(lines)
+		if err != nil {
+			return compacted, err
+		}
+
+		args := []any{day[0].day.Format(DayLayout), day[0].day.Unix(), len(lines), blob, archivePartPrefix}
+		for _, p := range day {
+			args = append(args, p.key)
+		}
+
+		res, err := replaceArchiveParts.Run(ctx, s.client, []string{keyArchives, keyArchiveSeq}, args...).Int()
+		if err != nil {
+			return compacted, err
+		}
+
+		if res < 0 {
+			return compacted, errArchivesChanged
+		}
+
+		compacted.Days++
+		compacted.Parts += len(day)
+		compacted.Duplicates += duplicates
+	}
+
+	return compacted, nil
+}
+
+// Drop deletes the archives of the days before the one of before. Their correlationIds are taken
+// out of payments:cids along with them, since nothing is left to be stored twice.
+func (s *Redis) Drop(ctx context.Context, before time.Time) (messages.DroppedArchives, error) {
+	dropped := messages.DroppedArchives{}
+
+	parts, err := s.partsBefore(ctx, before)
+	if err != nil || len(parts) == 0 {
+		return dropped, err
+	}
+
+	keys := make([]string, len(parts))
+	members := make([]any, len(parts))
+	days := make(map[time.Time]struct{})
+	var cids []any
+
+	for i, p := range parts {
+		keys[i] = p.key
+		members[i] = p.key
+		days[p.day] = struct{}{}
+
+		err := s.readPart(ctx, p.key, func(line string) {
+			if r, err := record.Decode(line); err == nil {
+				cids = append(cids, r.CID)
+			}
+		})
+		if err != nil {
+			return dropped, err
+		}
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.ZRem(ctx, keyArchives, members...)
+	pipe.Del(ctx, keys...)
+
+	for i := 0; i < len(cids); i += migrateChunk {
+		pipe.SRem(ctx, keyPaymentsStored, cids[i:min(i+migrateChunk, len(cids))]...)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return dropped, err
+	}
+
+	dropped.Days = len(days)
+	dropped.Parts = len(parts)
+
+	return dropped, nil
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/messages"
+	"github.com/rbenatti8/rinha-de-backend-2025/internal/record"
+	"strconv"
+	"time"
+)
+
+// Store keeps the processed payments. Implementations are safe for concurrent use.
+type Store interface {
+	// Store saves the payments whose correlationId is not stored yet and reports, for each one,
+	// whether it was stored. Storing a payment twice is harmless.
+	Store(ctx context.Context, payments []messages.PushPayment) ([]bool, error)
+	// Scan calls fn with each stored payment, in the order they were stored, and returns the number
+	// of records that could not be read. Payments requested outside of the from/to range, when
+	// set, may be skipped.
+	Scan(ctx context.Context, from, to *time.Time, fn func(record.Record)) (int, error)
+	// Quarantine moves the payments of the given correlationIds out of the stored payments, where
+	// they can still be inspected, and returns how many it moved.
+	Quarantine(ctx context.Context, cids []string) (int, error)
+	// DeadLetter keeps a payment whose outcome could not be determined, along with why.
+	DeadLetter(ctx context.Context, msg messages.DeadLetterPayment) error
+	// Migrate rewrites the payments stored in an older format.
+	Migrate(ctx context.Context) (messages.MigratedPayments, error)
+	// Purge deletes everything.
+	Purge(ctx context.Context) error
+}
+
+// Summarizer is implemented by stores that add the payments up themselves, faster than scanning
+// them all.
+type Summarizer interface {
+	Summarize(ctx context.Context, from, to *time.Time) (messages.SummarizedPayments, error)
+}
+
+// appendRecord appends the record of msg to buf: binary when the payment fits the format, as text
+// otherwise.
+func appendRecord(buf []byte, msg messages.PushPayment) []byte {
+	if r, err := record.New(msg.Payment.CID, msg.Payment.Amount, msg.Payment.RequestedAt, msg.ProcessedBy); err == nil {
+		if b, err := record.Append(buf, r); err == nil {
+			return b
+		}
+	}
+
+	buf = append(buf, msg.Payment.CID...)
+	buf = append(buf, '|')
+	buf = strconv.AppendFloat(buf, msg.Payment.Amount, 'f', -1, 64)
+	buf = append(buf, '|')
+	buf = append(buf, msg.Payment.RequestedAt...)
+	buf = append(buf, '|')
+	buf = append(buf, msg.ProcessedBy...)
+
+	return buf
+}
+
+func deadLetterRecord(msg messages.DeadLetterPayment) string {
+	return msg.Payment.CID + "|" +
+		strconv.FormatFloat(msg.Payment.Amount, 'f', -1, 64) + "|" +
+		msg.Payment.RequestedAt + "|" +
+		msg.Processor + "|" +
+		msg.Reason
+}
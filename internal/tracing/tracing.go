@@ -0,0 +1,133 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"os"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+
+	serviceName = "rinha-de-backend-2025"
+)
+
+var (
+	tracer     = otel.Tracer("github.com/rbenatti8/rinha-de-backend-2025")
+	propagator = propagation.TraceContext{}
+)
+
+type Config struct {
+	Exporter    string
+	FilePath    string
+	SampleRatio float64
+}
+
+// Setup installs the global tracer provider. The OTLP exporter reads its endpoint from the
+// standard OTEL_EXPORTER_OTLP_* environment variables.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		closer   io.Closer
+		err      error
+	)
+
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		var f *os.File
+		f, err = os.OpenFile(cfg.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		closer = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, errors.New("unknown tracing exporter: " + cfg.Exporter)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer.Close())
+		}
+
+		return err
+	}, nil
+}
+
+// StartFromRequest starts a span for an incoming request, continuing the trace from its
+// traceparent header when there is one.
+func StartFromRequest(req *fasthttp.Request, name string, attrs ...trace.SpanStartOption) trace.Span {
+	ctx := propagator.Extract(context.Background(), requestHeaderCarrier{&req.Header})
+	_, span := tracer.Start(ctx, name, append(attrs, trace.WithSpanKind(trace.SpanKindServer))...)
+
+	return span
+}
+
+// Start starts a span as a child of parent, which is usually carried inside an actor message.
+func Start(parent trace.SpanContext, name string, attrs ...trace.SpanStartOption) trace.Span {
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+	_, span := tracer.Start(ctx, name, attrs...)
+
+	return span
+}
+
+// Inject writes the span's context into an outgoing request as a traceparent header.
+func Inject(span trace.Span, req *fasthttp.Request) {
+	ctx := trace.ContextWithSpan(context.Background(), span)
+	propagator.Inject(ctx, requestHeaderCarrier{&req.Header})
+}
+
+type requestHeaderCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+func (c requestHeaderCarrier) Get(key string) string {
+	return string(c.header.Peek(key))
+}
+
+func (c requestHeaderCarrier) Set(key, value string) {
+	c.header.Set(key, value)
+}
+
+func (c requestHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, c.header.Len())
+	for k := range c.header.All() {
+		keys = append(keys, string(k))
+	}
+
+	return keys
+}
@@ -1,7 +1,22 @@
-CREATE UNLOGGED TABLE payments (
-    correlationId UUID PRIMARY KEY,
-    amount DECIMAL NOT NULL,
-    requested_at TIMESTAMP NOT NULL
-);
-
-CREATE INDEX payments_requested_at ON payments (requested_at);
+-- The payment processors keep their payments in this table, and so does the API when
+-- storage.backend is postgres. Only the API sets processor; quarantined_payments and
+-- dead_letter_payments are the API's alone. internal/storage/postgres.go creates the same tables.
+CREATE TABLE IF NOT EXISTS payments (
+    correlationId UUID PRIMARY KEY,
+    amount DECIMAL NOT NULL,
+    requested_at TIMESTAMP NOT NULL,
+    processor TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS payments_requested_at ON payments (requested_at);
+
+CREATE TABLE IF NOT EXISTS quarantined_payments (LIKE payments INCLUDING DEFAULTS);
+
+CREATE TABLE IF NOT EXISTS dead_letter_payments (
+    correlationId TEXT NOT NULL,
+    amount DECIMAL NOT NULL,
+    requested_at TEXT NOT NULL,
+    processor TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);